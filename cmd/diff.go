@@ -16,19 +16,142 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
 
 	"github.com/bitnami/kubecfg/pkg/kubecfg"
 )
 
 const (
-	flagDiffStrategy = "diff-strategy"
-	flagOmitSecrets  = "omit-secrets"
+	flagDiffStrategy         = "diff-strategy"
+	flagOmitSecrets          = "omit-secrets"
+	flagDiffLayout           = "layout"
+	flagDiffWidth            = "width"
+	flagDiffContext          = "diff-context"
+	flagFromFile             = "from-file"
+	flagConcurrency          = "concurrency"
+	flagIgnorePath           = "ignore-path"
+	flagErrorOnDiff          = "error-on-diff"
+	flagSerialization        = "serialization"
+	flagIgnoreDefaults       = "ignore-server-defaults"
+	flagContinueOnError      = "continue-on-error"
+	flagDiffFilter           = "filter"
+	flagGranularity          = "granularity"
+	flagSensitiveAnno        = "sensitive-annotation"
+	flagShowManagers         = "show-managers"
+	flagQuiet                = "quiet"
+	flagColor                = "color"
+	flagEmitPatch            = "emit-patch"
+	flagStat                 = "stat"
+	flagSelector             = "selector"
+	flagIncludeStatus        = "include-status"
+	flagMaxObjectBytes       = "max-object-bytes"
+	flagNormalizeAPIVersion  = "normalize-api-version"
+	flagHunkPaths            = "hunk-paths"
+	flagKeepServerMetadata   = "keep-server-metadata"
+	flagPatchFormat          = "patch-format"
+	flagFetchAttempts        = "fetch-attempts"
+	flagManagedAnnotation    = "managed-annotation"
+	flagShowCreateBody       = "show-create-body"
+	flagStrategyForKind      = "strategy-for-kind"
+	flagDiffOrder            = "order"
+	flagDetectOrphans        = "detect-orphans"
+	flagRedactPublicCerts    = "redact-public-certs"
+	flagKeepManagedFields    = "keep-managed-fields"
+	flagIndent               = "indent"
+	flagWarnImmutable        = "warn-immutable"
+	flagSecretRedactMode     = "secret-redact-mode"
+	flagSection              = "section"
+	flagOffline              = "offline"
+	flagOnlyNamespace        = "only-namespace"
+	flagIncludeClusterScoped = "include-cluster-scoped"
+	flagIncludeDependents    = "include-dependents"
+	flagDiffTimeout          = "diff-timeout"
+	flagSummary              = "summary"
+	flagMatchBy              = "match-by"
+	flagAgainst              = "against"
+	flagShowExtraLiveFields  = "show-extra-live-fields"
+	flagPager                = "pager"
+	flagStatus               = "status"
+	flagIgnoreWhitespace     = "ignore-whitespace"
+	flagSuppressLines        = "suppress-lines"
+	flagShowHash             = "show-hash"
+	flagDeletionPreview      = "deletion-preview"
+	flagReportConflicts      = "report-conflicts"
+	flagMaxValueLen          = "max-value-len"
+	flagGroupByKind          = "group-by-kind"
+	flagStrictCRD            = "strict-crd"
+	flagOutputDir            = "output-dir"
 )
 
 func init() {
-	diffCmd.PersistentFlags().String(flagDiffStrategy, "all", "Diff strategy, all or subset.")
+	diffCmd.PersistentFlags().String(flagDiffStrategy, "all", "Diff strategy, all, subset, 3way or server.")
 	diffCmd.PersistentFlags().Bool(flagOmitSecrets, false, "hide secret details when showing diff")
+	diffCmd.PersistentFlags().String(flagDiffLayout, kubecfg.DiffLayoutUnified, "Diff layout, unified or sidebyside.")
+	diffCmd.PersistentFlags().Int(flagDiffWidth, 0, "Output width for sidebyside layout. Defaults to the terminal width.")
+	diffCmd.PersistentFlags().Int(flagDiffContext, -1, "Number of unchanged lines to show around each change. Negative means unlimited.")
+	diffCmd.PersistentFlags().String(flagFromFile, "", "Compare against the objects in this manifest file or directory, instead of the server")
+	diffCmd.PersistentFlags().Int(flagConcurrency, 1, "Maximum number of objects to fetch from the server in parallel")
+	diffCmd.PersistentFlags().StringArray(flagIgnorePath, nil, "Field to ignore when diffing, eg: status or metadata.annotations[\"example.com/foo\"]. May be repeated.")
+	diffCmd.PersistentFlags().Bool(flagErrorOnDiff, true, "Exit with a non-zero status if differences are found")
+	diffCmd.PersistentFlags().String(flagSerialization, "json", "Format objects are rendered in before diffing, json or yaml")
+	diffCmd.PersistentFlags().Bool(flagIgnoreDefaults, false, "Hide live fields absent from config and set to their documented default")
+	diffCmd.PersistentFlags().Bool(flagContinueOnError, false, "Warn about objects that can't be diffed and carry on with the rest")
+	diffCmd.PersistentFlags().String(flagDiffFilter, kubecfg.DiffFilterAll, "Only show objects that would be created or changed. One of: all, created, changed")
+	diffCmd.PersistentFlags().String(flagGranularity, kubecfg.DiffGranularityLine, "Highlight changes by line, or also by word within changed lines. One of: line, word")
+	diffCmd.PersistentFlags().String(flagSensitiveAnno, "", "Hide details of objects with this annotation when showing diff, as for secrets")
+	diffCmd.PersistentFlags().Bool(flagShowManagers, false, "Show the field manager that owns each changed line")
+	diffCmd.PersistentFlags().BoolP(flagQuiet, "q", false, "Don't show unchanged objects")
+	diffCmd.PersistentFlags().String(flagColor, kubecfg.DiffColorAuto, "When to colorize the diff. One of: auto, always, never")
+	diffCmd.PersistentFlags().String(flagFormat, kubecfg.DiffFormatText, "Output format. One of: text, html, names")
+	diffCmd.PersistentFlags().Bool(flagEmitPatch, false, "Also show the patch that update would send for each changed object")
+	diffCmd.PersistentFlags().Bool(flagStat, false, "Only show the number of lines added and removed for each object")
+	diffCmd.PersistentFlags().StringP(flagSelector, "l", "", "Only diff config objects with matching labels, eg: app=frontend")
+	diffCmd.PersistentFlags().Bool(flagIncludeStatus, false, "Include the status of objects in the diff")
+	diffCmd.PersistentFlags().Int(flagMaxObjectBytes, 0, "Only show the change in size of objects larger than this many bytes. Zero means no limit.")
+	diffCmd.PersistentFlags().Bool(flagNormalizeAPIVersion, false, "Convert config objects to the server's preferred version of their kind before diffing")
+	diffCmd.PersistentFlags().Bool(flagHunkPaths, false, "Label each change with the path of the field it is in")
+	diffCmd.PersistentFlags().Bool(flagKeepServerMetadata, false, "Include metadata set by the server, such as resourceVersion and uid, in the diff")
+	diffCmd.PersistentFlags().String(flagPatchFormat, kubecfg.PatchFormatUpdate, "Encoding of --emit-patch patches. One of: update, json")
+	diffCmd.PersistentFlags().Int(flagFetchAttempts, 1, "Number of times to try fetching each object from the server, when it fails with a transient error")
+	diffCmd.PersistentFlags().StringArray(flagManagedAnnotation, kubecfg.DefaultManagedAnnotations, "Annotation maintained by tools rather than config, to ignore when diffing. May be repeated.")
+	diffCmd.PersistentFlags().Bool(flagShowCreateBody, false, "Show the whole of each object that would be created")
+	diffCmd.PersistentFlags().StringToString(flagStrategyForKind, nil, "Diff strategy to use for objects of a kind, or skip to leave them out, eg: Deployment=3way,Job=skip")
+	diffCmd.PersistentFlags().String(flagDiffOrder, kubecfg.DiffOrderAlpha, "Order to show objects in. One of: alpha, apply")
+	diffCmd.PersistentFlags().Bool(flagDetectOrphans, false, "Also show objects with --"+flagGcTag+" that are not in config, and would be garbage collected")
+	diffCmd.PersistentFlags().String(flagGcTag, "", "Garbage collection tag, see --"+flagDetectOrphans)
+	diffCmd.PersistentFlags().String(flagOutputDir, "", "Write each object's diff to a file in this directory, with an index.txt, instead of stdout")
+	diffCmd.PersistentFlags().Bool(flagRedactPublicCerts, false, "Also hide TLS certificates with --"+flagOmitSecrets)
+	diffCmd.PersistentFlags().Bool(flagKeepManagedFields, false, "Include metadata.managedFields in the diff")
+	diffCmd.PersistentFlags().String(flagIndent, "", "Indentation of JSON objects in the diff, spaces or tabs (default two spaces)")
+	diffCmd.PersistentFlags().Bool(flagWarnImmutable, false, "Warn about changes to immutable fields, that would fail to update")
+	diffCmd.PersistentFlags().String(flagSecretRedactMode, kubecfg.SecretRedactValues, "How --"+flagOmitSecrets+" hides Secret data. One of: values (keep keys), full")
+	diffCmd.PersistentFlags().StringSlice(flagSection, nil, "Only diff these top-level fields, eg: metadata, spec (default all)")
+	diffCmd.PersistentFlags().Bool(flagOffline, false, "Show every object as created, without contacting the server")
+	diffCmd.PersistentFlags().StringArray(flagOnlyNamespace, nil, "Only diff objects in this namespace. May be repeated.")
+	diffCmd.PersistentFlags().Bool(flagIncludeClusterScoped, false, "Also diff cluster-scoped objects with --"+flagOnlyNamespace)
+	diffCmd.PersistentFlags().Bool(flagIncludeDependents, false, "Also show the live objects owned by each object, eg: a Deployment's ReplicaSets and Pods")
+	diffCmd.PersistentFlags().Duration(flagDiffTimeout, 0, "Time to spend computing each object's diff before settling for a less minimal one, or negative for no limit (default 1s)")
+	diffCmd.PersistentFlags().Bool(flagSummary, false, "End with a count of the objects changed, created and unchanged")
+	diffCmd.PersistentFlags().String(flagMatchBy, "", "Label used to find the live version of objects without a name, eg: with generateName")
+	diffCmd.PersistentFlags().String(flagAgainst, "", "Diff live objects against something other than config. One of: previous-annotation")
+	diffCmd.PersistentFlags().Bool(flagShowExtraLiveFields, false, "With --"+flagDiffStrategy+"=subset, show live fields absent from config as deletions")
+	diffCmd.PersistentFlags().String(flagPager, "", "Command to page output to a terminal through, eg: \"less -R\"")
+	diffCmd.PersistentFlags().Bool(flagStatus, false, "Write a line of JSON counting the objects of each status to stderr")
+	diffCmd.PersistentFlags().Bool(flagIgnoreWhitespace, false, "Ignore changes to leading, trailing and repeated whitespace in string values")
+	diffCmd.PersistentFlags().StringArray(flagSuppressLines, nil, "Regexp of changed lines to leave out of the diff. May be repeated.")
+	diffCmd.PersistentFlags().Bool(flagShowHash, false, "Show a fingerprint of each config object in its header")
+	diffCmd.PersistentFlags().Bool(flagDeletionPreview, false, "Show the effect of deleting each object, rather than applying it")
+	diffCmd.PersistentFlags().Bool(flagReportConflicts, false, "With --diff-strategy=server, report conflicts returned by the dry run patch rather than failing")
+	diffCmd.PersistentFlags().Int(flagMaxValueLen, 0, "Cut string values longer than this many characters short. Zero means no limit.")
+	diffCmd.PersistentFlags().Bool(flagValidate, false, "Warn of objects that don't match the server's schema")
+	diffCmd.PersistentFlags().Bool(flagGroupByKind, false, "Show objects grouped by kind, with a header for each")
+	diffCmd.PersistentFlags().Bool(flagStrictCRD, false, "Fail if objects are of kinds the server doesn't serve, eg: with missing CRDs")
 	RootCmd.AddCommand(diffCmd)
 }
 
@@ -52,11 +175,332 @@ var diffCmd = &cobra.Command{
 			return err
 		}
 
-		c.Client, c.Mapper, _, err = getDynamicClients(cmd)
+		c.Layout, err = flags.GetString(flagDiffLayout)
+		if err != nil {
+			return err
+		}
+
+		c.Width, err = flags.GetInt(flagDiffWidth)
+		if err != nil {
+			return err
+		}
+
+		c.Context, err = flags.GetInt(flagDiffContext)
+		if err != nil {
+			return err
+		}
+
+		c.FromFile, err = flags.GetString(flagFromFile)
+		if err != nil {
+			return err
+		}
+
+		c.Concurrency, err = flags.GetInt(flagConcurrency)
+		if err != nil {
+			return err
+		}
+
+		c.IgnorePaths, err = flags.GetStringArray(flagIgnorePath)
+		if err != nil {
+			return err
+		}
+
+		errorOnDiff, err := flags.GetBool(flagErrorOnDiff)
+		if err != nil {
+			return err
+		}
+		c.ErrorOnDiff = &errorOnDiff
+
+		c.Serialization, err = flags.GetString(flagSerialization)
+		if err != nil {
+			return err
+		}
+
+		c.IgnoreServerDefaults, err = flags.GetBool(flagIgnoreDefaults)
+		if err != nil {
+			return err
+		}
+
+		c.ContinueOnError, err = flags.GetBool(flagContinueOnError)
+		if err != nil {
+			return err
+		}
+
+		c.SensitiveAnnotation, err = flags.GetString(flagSensitiveAnno)
+		if err != nil {
+			return err
+		}
+
+		c.Format, err = flags.GetString(flagFormat)
+		if err != nil {
+			return err
+		}
+
+		c.Color, err = flags.GetString(flagColor)
+		if err != nil {
+			return err
+		}
+
+		c.StrictCRD, err = flags.GetBool(flagStrictCRD)
+		if err != nil {
+			return err
+		}
+
+		c.GroupByKind, err = flags.GetBool(flagGroupByKind)
+		if err != nil {
+			return err
+		}
+
+		c.Validate, err = flags.GetBool(flagValidate)
+		if err != nil {
+			return err
+		}
+
+		c.MaxValueLen, err = flags.GetInt(flagMaxValueLen)
+		if err != nil {
+			return err
+		}
+
+		c.ReportConflicts, err = flags.GetBool(flagReportConflicts)
+		if err != nil {
+			return err
+		}
+
+		c.DeletionPreview, err = flags.GetBool(flagDeletionPreview)
+		if err != nil {
+			return err
+		}
+
+		c.ShowHash, err = flags.GetBool(flagShowHash)
+		if err != nil {
+			return err
+		}
+
+		suppress, err := flags.GetStringArray(flagSuppressLines)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range suppress {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid --%s pattern %q: %v", flagSuppressLines, pattern, err)
+			}
+			c.SuppressLines = append(c.SuppressLines, re)
+		}
+
+		c.IgnoreWhitespace, err = flags.GetBool(flagIgnoreWhitespace)
+		if err != nil {
+			return err
+		}
+
+		status, err := flags.GetBool(flagStatus)
+		if err != nil {
+			return err
+		}
+		if status {
+			c.Status = os.Stderr
+		}
+
+		c.Pager, err = flags.GetString(flagPager)
+		if err != nil {
+			return err
+		}
+
+		c.ShowExtraLiveFields, err = flags.GetBool(flagShowExtraLiveFields)
+		if err != nil {
+			return err
+		}
+
+		c.Against, err = flags.GetString(flagAgainst)
+		if err != nil {
+			return err
+		}
+
+		c.MatchBy, err = flags.GetString(flagMatchBy)
+		if err != nil {
+			return err
+		}
+
+		c.Summary, err = flags.GetBool(flagSummary)
+		if err != nil {
+			return err
+		}
+
+		c.DiffTimeout, err = flags.GetDuration(flagDiffTimeout)
+		if err != nil {
+			return err
+		}
+
+		c.IncludeDependents, err = flags.GetBool(flagIncludeDependents)
+		if err != nil {
+			return err
+		}
+
+		c.Namespaces, err = flags.GetStringArray(flagOnlyNamespace)
+		if err != nil {
+			return err
+		}
+
+		c.IncludeClusterScoped, err = flags.GetBool(flagIncludeClusterScoped)
+		if err != nil {
+			return err
+		}
+
+		c.Offline, err = flags.GetBool(flagOffline)
+		if err != nil {
+			return err
+		}
+
+		c.Sections, err = flags.GetStringSlice(flagSection)
 		if err != nil {
 			return err
 		}
 
+		c.SecretRedactMode, err = flags.GetString(flagSecretRedactMode)
+		if err != nil {
+			return err
+		}
+
+		c.WarnImmutable, err = flags.GetBool(flagWarnImmutable)
+		if err != nil {
+			return err
+		}
+
+		c.Indent, err = flags.GetString(flagIndent)
+		if err != nil {
+			return err
+		}
+
+		c.KeepManagedFields, err = flags.GetBool(flagKeepManagedFields)
+		if err != nil {
+			return err
+		}
+
+		c.RedactPublicCerts, err = flags.GetBool(flagRedactPublicCerts)
+		if err != nil {
+			return err
+		}
+
+		c.OutputDir, err = flags.GetString(flagOutputDir)
+		if err != nil {
+			return err
+		}
+
+		c.DetectOrphans, err = flags.GetBool(flagDetectOrphans)
+		if err != nil {
+			return err
+		}
+
+		c.GcTag, err = flags.GetString(flagGcTag)
+		if err != nil {
+			return err
+		}
+
+		c.Order, err = flags.GetString(flagDiffOrder)
+		if err != nil {
+			return err
+		}
+
+		c.StrategyByKind, err = flags.GetStringToString(flagStrategyForKind)
+		if err != nil {
+			return err
+		}
+
+		c.ShowCreateBody, err = flags.GetBool(flagShowCreateBody)
+		if err != nil {
+			return err
+		}
+
+		c.ManagedAnnotations, err = flags.GetStringArray(flagManagedAnnotation)
+		if err != nil {
+			return err
+		}
+
+		attempts, err := flags.GetInt(flagFetchAttempts)
+		if err != nil {
+			return err
+		}
+		if attempts > 1 {
+			c.RetryPolicy = &wait.Backoff{
+				Duration: 500 * time.Millisecond,
+				Factor:   2,
+				Jitter:   0.1,
+				Steps:    attempts,
+			}
+		}
+
+		c.PatchFormat, err = flags.GetString(flagPatchFormat)
+		if err != nil {
+			return err
+		}
+
+		c.KeepServerMetadata, err = flags.GetBool(flagKeepServerMetadata)
+		if err != nil {
+			return err
+		}
+
+		c.HunkPaths, err = flags.GetBool(flagHunkPaths)
+		if err != nil {
+			return err
+		}
+
+		c.NormalizeAPIVersion, err = flags.GetBool(flagNormalizeAPIVersion)
+		if err != nil {
+			return err
+		}
+
+		c.MaxObjectBytes, err = flags.GetInt(flagMaxObjectBytes)
+		if err != nil {
+			return err
+		}
+
+		c.IncludeStatus, err = flags.GetBool(flagIncludeStatus)
+		if err != nil {
+			return err
+		}
+
+		c.LabelSelector, err = flags.GetString(flagSelector)
+		if err != nil {
+			return err
+		}
+
+		c.Stat, err = flags.GetBool(flagStat)
+		if err != nil {
+			return err
+		}
+
+		c.EmitPatch, err = flags.GetBool(flagEmitPatch)
+		if err != nil {
+			return err
+		}
+
+		c.Quiet, err = flags.GetBool(flagQuiet)
+		if err != nil {
+			return err
+		}
+
+		c.ShowManagers, err = flags.GetBool(flagShowManagers)
+		if err != nil {
+			return err
+		}
+
+		c.Granularity, err = flags.GetString(flagGranularity)
+		if err != nil {
+			return err
+		}
+
+		c.Filter, err = flags.GetString(flagDiffFilter)
+		if err != nil {
+			return err
+		}
+
+		if !c.Offline {
+			c.Client, c.Mapper, c.Discovery, err = getDynamicClients(cmd)
+			if err != nil {
+				return err
+			}
+		}
+
 		c.DefaultNamespace, err = defaultNamespace(clientConfig)
 		if err != nil {
 			return err
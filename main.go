@@ -16,6 +16,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -37,8 +38,9 @@ func main() {
 		log.SetFormatter(logFmt)
 		log.Error(err.Error())
 
-		switch err {
-		case kubecfg.ErrDiffFound:
+		switch {
+		case errors.Is(err, kubecfg.ErrDiffFound):
+			// Creates only or not, see kubecfg.ErrCreatesOnly
 			os.Exit(10)
 		default:
 			os.Exit(1)
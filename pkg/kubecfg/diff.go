@@ -17,142 +17,4173 @@ package kubecfg
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/googleapis/gnostic/OpenAPIv2"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	yaml "gopkg.in/yaml.v2"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/kube-openapi/pkg/util/proto"
+	"k8s.io/kube-openapi/pkg/util/proto/validation"
+	"k8s.io/kubernetes/pkg/kubectl/cmd/util/openapi"
 
 	"github.com/bitnami/kubecfg/utils"
 )
 
+// ErrDiffFound matches, with errors.Is, the error Run returns when
+// differences are found: ErrCreatesOnly or ErrModifications.
 var ErrDiffFound = fmt.Errorf("Differences found.")
 
+var (
+	// ErrCreatesOnly is returned when the only differences are
+	// objects that would be created.
+	ErrCreatesOnly error = diffFoundError("Differences found: new objects only.")
+	// ErrModifications is returned when any existing object would
+	// be changed (or garbage collected).
+	ErrModifications error = diffFoundError("Differences found.")
+)
+
+// diffFoundError is a kind of ErrDiffFound.
+type diffFoundError string
+
+func (e diffFoundError) Error() string { return string(e) }
+
+func (e diffFoundError) Is(target error) bool { return target == ErrDiffFound }
+
 // Matches all the line starts on a diff text, which is where we put diff markers and indent
 var DiffLineStart = regexp.MustCompile("(^|\n)(.)")
 
-var DiffKeyValue = regexp.MustCompile(`"([-._a-zA-Z0-9]+)":\s"([[:alnum:]=+]+)",?`)
+const (
+	// DiffLayoutUnified shows live and config interleaved in a
+	// single column, with +/- markers
+	DiffLayoutUnified = "unified"
+	// DiffLayoutSideBySide shows live on the left and config on
+	// the right, aligned line by line
+	DiffLayoutSideBySide = "sidebyside"
+
+	// DiffStrategyThreeWay compares live against the result of
+	// the three-way merge that `kubecfg update` would perform
+	// between the AnnotationOrigObject annotation (last applied
+	// config), live and config.  Fields removed from config since
+	// the last update show as deletions, while other fields only
+	// present on the server are kept.
+	DiffStrategyThreeWay = "3way"
+	// DiffStrategyServer compares live against the object the
+	// server returns for a dry-run of the DiffStrategyThreeWay
+	// patch, including any defaulting and mutating admission
+	// webhooks.  The patch is sent as a strategic merge patch, or
+	// a JSON merge patch for kinds without a schema, not a
+	// server-side apply.  Like update, it sets no field manager
+	// (the vendored client predates them), so managed fields are
+	// recorded as for a real update.  Requires Client, so is not
+	// available with a LiveSource.
+	DiffStrategyServer = "server"
+	// DiffStrategySkip, in DiffCmd.StrategyByKind, leaves objects
+	// of that kind out of the diff entirely
+	DiffStrategySkip = "skip"
+	// AnnotationDiffStrategy, set on a config object, is the diff
+	// strategy for that object (including DiffStrategySkip), in
+	// place of DiffCmd.DiffStrategy and StrategyByKind
+	AnnotationDiffStrategy = "kubecfg.bitnami.com/diff-strategy"
+
+	// DiffFormatText is plain (or colorized) text
+	DiffFormatText = "text"
+	// DiffFormatHTML is HTML, for embedding in web pages
+	DiffFormatHTML = "html"
+	// DiffFormatNames is one line per object, with no diff: "~"
+	// (changed), "+" (to create), "=" (unchanged), "-" (orphaned)
+	// or "!" (error), then apiVersion/Kind/namespace/name
+	DiffFormatNames = "names"
+
+	// DiffColorAuto colorizes output written to a terminal, unless
+	// the NO_COLOR environment variable is set
+	DiffColorAuto = "auto"
+	// DiffColorAlways always colorizes output, eg: for `less -R`
+	DiffColorAlways = "always"
+	// DiffColorNever never colorizes output
+	DiffColorNever = "never"
+
+	// DiffGranularityLine highlights changed lines
+	DiffGranularityLine = "line"
+	// DiffGranularityWord additionally highlights changes within
+	// lines
+	DiffGranularityWord = "word"
+
+	// DiffFilterAll shows every object
+	DiffFilterAll = "all"
+	// DiffFilterCreated shows only objects missing from the server
+	DiffFilterCreated = string(DiffStatusCreated)
+	// DiffFilterChanged shows only objects that differ from the
+	// server
+	DiffFilterChanged = string(DiffStatusChanged)
+
+	// DiffOrderAlpha diffs objects in namespace/name/kind order
+	DiffOrderAlpha = "alpha"
+	// DiffOrderApply diffs objects in the order `kubecfg update`
+	// applies them, with dependencies (eg: CRDs) first
+	DiffOrderApply = "apply"
+
+	// AgainstPreviousAnnotation, as DiffCmd.Against, diffs each
+	// live object against the previous version recorded in its
+	// AnnotationPrevious annotation
+	AgainstPreviousAnnotation = "previous-annotation"
+	// AnnotationPrevious holds an earlier serialization of the
+	// object it's set on, as JSON or YAML
+	AnnotationPrevious = "kubecfg.bitnami.com/previous"
+
+	// PatchFormatUpdate is the patch `kubecfg update` would send
+	PatchFormatUpdate = "update"
+	// PatchFormatJSON is an RFC 6902 JSON Patch, from live to the
+	// object the diff compares it with
+	PatchFormatJSON = "json"
+
+	// SecretRedactValues replaces each value of a Secret's data
+	// with a placeholder, showing which keys changed
+	SecretRedactValues = "values"
+	// SecretRedactFull replaces all of a Secret's data with a
+	// single placeholder, hiding its keys too
+	SecretRedactFull = "full"
+
+	// Placeholders for redacted values.  A changed value is
+	// marked as such on the config side, so the diff still shows
+	// which keys changed.
+	omittedValue        = "<omitted>"
+	omittedChangedValue = "<omitted (changed)>"
+
+	// Output width used for side-by-side diffs when the terminal
+	// size is unknown (same as diff(1) --side-by-side)
+	defaultDiffWidth = 130
+)
+
+// DiffCmd represents the diff subcommand
+type DiffCmd struct {
+	Client           dynamic.Interface
+	Mapper           meta.RESTMapper
+	Discovery        discovery.DiscoveryInterface
+	DefaultNamespace string
+	OmitSecrets      bool
+	// RedactPublicCerts also redacts the certificates of TLS
+	// Secrets with OmitSecrets.  By default they're shown, since
+	// they aren't secret, while their tls.key is always redacted.
+	RedactPublicCerts bool
+	// SecretRedactMode is how OmitSecrets redacts Secret data,
+	// SecretRedactValues (the default if empty) or
+	// SecretRedactFull.
+	SecretRedactMode string
+	// SensitiveAnnotation, if set, is an annotation that marks
+	// objects of any kind to be redacted like a Secret.  Its value
+	// is "true", or a comma-separated list of field paths to redact
+	// (eg: "data,spec.password").
+	SensitiveAnnotation string
+
+	// DiffStrategy is "all" (the default), "subset" to ignore
+	// live fields absent from config, DiffStrategyThreeWay or
+	// DiffStrategyServer.  Any other value is an error.
+	DiffStrategy string
+	// StrategyByKind overrides DiffStrategy for objects of the
+	// given kinds, eg: {"Deployment": "3way", "Job": "skip"}.
+	// AnnotationDiffStrategy on an object overrides both.
+	StrategyByKind map[string]string
+	// ShowExtraLiveFields, with the "subset" strategy, keeps live
+	// fields absent from config, so they show as deletions (eg:
+	// fields set by controllers, that could be added to config).
+	// Config's empty values are still matched with missing live
+	// fields.
+	ShowExtraLiveFields bool
+
+	// Layout is DiffLayoutUnified (the default if empty) or
+	// DiffLayoutSideBySide
+	Layout string
+	// Format is DiffFormatText (the default if empty),
+	// DiffFormatHTML for a <pre> block per object, with
+	// diff-add/diff-del spans in place of colors, or
+	// DiffFormatNames for just the name and status of each object
+	Format string
+	// Color is DiffColorAuto (the default if empty),
+	// DiffColorAlways or DiffColorNever.  Ignored for HTML.
+	Color string
+	// ForceTTY, if non-nil, overrides whether the output is
+	// treated as a terminal when choosing colors and the pager.
+	ForceTTY *bool
+	// Width is the total output width of side-by-side diffs.  If
+	// zero, the terminal width is used when known.
+	Width int
+	// Context is the number of unchanged lines to show around
+	// each change, like diff -U.  Negative means unlimited.
+	Context int
+	// Granularity is DiffGranularityLine (the default if empty),
+	// or DiffGranularityWord to also highlight the changed words
+	// within changed lines.  Word highlighting needs color, and
+	// only applies to the unified layout.
+	Granularity string
+
+	// Targets, if set, are several clusters to diff against in
+	// place of Client, Mapper and Discovery.  Each target gets its
+	// own section of output, followed by a summary of each
+	// object's status in every target.
+	Targets []DiffTarget
+
+	// LiveSource provides the live objects to compare against.
+	// If nil, objects are read from FromFile if set, or fetched
+	// from the server otherwise.
+	LiveSource LiveSource
+	// FromFile is a manifest file, or directory of manifests, to
+	// use in place of the server
+	FromFile string
+	// Against, if set, replaces config as the object that live
+	// is compared with.  AgainstPreviousAnnotation shows what
+	// changed in each live object since the version recorded in
+	// it.  Config objects are then only used to select which live
+	// objects to show.
+	Against string
+
+	// MatchBy is a label key, used to find the live version of
+	// config objects without a name (eg: with generateName) from
+	// the server: the live object with the same value for the
+	// label.  An object with no match is new, while several
+	// matches are an error.
+	MatchBy string
+	// Offline diffs without any access to the server, showing
+	// every object in full as created.  Client and Discovery are
+	// not used, and Mapper may be nil.
+	Offline bool
+
+	// Concurrency is the maximum number of live objects to fetch
+	// in parallel.  Values less than 1 mean 1.
+	Concurrency int
+
+	// RetryPolicy, if set, retries fetching live objects that fail
+	// with a transient error (see isRetryable), up to Steps
+	// attempts in all.  nil means no retries.
+	RetryPolicy *wait.Backoff
+
+	// IncludeStatus includes the top-level status field in the
+	// diff.  By default it is removed from both live and config
+	// objects, since it is maintained by the server.
+	IncludeStatus bool
+
+	// Sections, if not empty, limits the diff to these top-level
+	// fields, eg: "metadata", "spec", "data" or "status" (which
+	// implies IncludeStatus).  apiVersion and kind are always
+	// kept.
+	Sections []string
+
+	// IgnorePaths are fields to remove from both live and config
+	// objects before diffing, eg: "status" or
+	// `metadata.annotations["example.com/foo"]`.  Paths that
+	// traverse a list apply to every element.
+	IgnorePaths []string
+	// IgnoreWhitespace trims each line of every string value, and
+	// collapses runs of whitespace within lines to a single space,
+	// before diffing, so eg: reindenting a config file embedded in
+	// a ConfigMap isn't a change.  Values are shown normalized.
+	IgnoreWhitespace bool
+	// SuppressLines are patterns for changed lines to leave out
+	// of diffs, eg: a timestamp annotation updated by a
+	// controller.  A deleted line that matches is shown as
+	// unchanged, and a matching insertion is dropped, so an
+	// object whose changes all match is unchanged.  Lines are
+	// matched as serialized, without the leading "- " or "+ ".
+	SuppressLines []*regexp.Regexp
+
+	// ErrorOnDiff controls whether Run returns ErrDiffFound when
+	// differences are found.  nil means true.
+	ErrorOnDiff *bool
+
+	// Serialization is the format objects are rendered in before
+	// diffing, "json" (the default if empty) or "yaml"
+	Serialization string
+	// Indent is the indentation of each level of JSON
+	// serialization, spaces or tabs.  Defaults to two spaces.
+	Indent string
+
+	// SchemaCache, if set, caches the server's OpenAPI schema
+	// between runs, eg: a *MemorySchemaCache shared by several
+	// DiffCmds.
+	SchemaCache SchemaCache
+	// Cache, if set, keeps the diff of each object between runs,
+	// so objects whose config and live resourceVersion are both
+	// unchanged aren't diffed again.  Live objects are still
+	// fetched.  A cache shouldn't be shared by DiffCmds with
+	// different settings.
+	Cache DiffCache
+
+	// IgnoreServerDefaults hides live fields that are absent from
+	// config and set to the default documented in the server's
+	// OpenAPI schema (eg: dnsPolicy: ClusterFirst).  Requires
+	// Discovery.
+	IgnoreServerDefaults bool
+
+	// ContinueOnError reports objects that can't be fetched or
+	// diffed with a warning and carries on with the rest, rather
+	// than aborting.  All such errors are returned together at
+	// the end.
+	ContinueOnError bool
+
+	// OnProgress, if set, is called after each live object is
+	// fetched with the number fetched so far and the total.
+	// Calls are never concurrent.
+	OnProgress func(done, total int)
+
+	// OnObject, if set, is called once for each object diffed,
+	// in output order, whether or not it is shown: with the
+	// config object (or the live object, for orphans), whether it
+	// differs from the server, and its diff.  The diff is nil for
+	// objects that failed, or weren't diffed.
+	OnObject func(obj *unstructured.Unstructured, changed bool, diff []diffmatchpatch.Diff)
+
+	// ShowManagers annotates each changed line with the field
+	// manager that owns it, according to the live object's
+	// metadata.managedFields.  Only supported with JSON
+	// serialization.
+	ShowManagers bool
+
+	// EmitPatch shows the patch `kubecfg update` would send for
+	// each changed object, after its diff.  The patch is not
+	// shown for redacted objects (see OmitSecrets).
+	EmitPatch bool
+	// PatchFormat is the encoding of EmitPatch patches,
+	// PatchFormatUpdate (the default if empty) or PatchFormatJSON
+	PatchFormat string
+
+	// Stat shows a one line summary per object, with the number
+	// of lines added and removed, in place of the full diff.
+	Stat bool
+	// ShowHash adds a fingerprint of each config object to its
+	// header, and sets ObjectDiff.Hash, to tell whether config
+	// changed between runs regardless of the live state.
+	ShowHash bool
+
+	// Summary ends the output with a line counting the objects
+	// of each status.
+	Summary bool
+	// Status, if set, is written a line of JSON counting the
+	// objects of each status once the diff is done, eg:
+	// {"changed":3,"created":1,"unchanged":0,"orphaned":0,"errors":0}.
+	// This is separate from the diff output, for scripts.
+	Status io.Writer
+
+	// Pager, if set, is a shell command to pipe the output
+	// through when out is a terminal, eg: "less -R" (which shows
+	// colors).
+	Pager string
+	// Sinks are further writers that get a copy of the output, each
+	// colored according to its own Color setting (eg: a plain log
+	// file alongside a colored terminal).  The diff is only
+	// computed once, but output is buffered until it's complete.
+	Sinks []DiffSink
+
+	// Quiet omits unchanged objects from the output entirely.
+	Quiet bool
+
+	// LabelSelector, if set, restricts the diff to config objects
+	// with matching labels, eg: "app=frontend".  Note this
+	// matches the labels in config, not on the server.
+	LabelSelector string
+
+	// Namespaces, if set, restricts the diff to objects in these
+	// namespaces (after DefaultNamespace is applied).
+	// Cluster-scoped objects are left out too, unless
+	// IncludeClusterScoped.
+	Namespaces           []string
+	IncludeClusterScoped bool
+
+	// SourcePaths maps config objects to the file each was read
+	// from, for OnlySourcePaths.
+	SourcePaths map[*unstructured.Unstructured]string
+	// OnlySourcePaths, if not nil, restricts the diff to config
+	// objects whose SourcePaths file is one of these, eg: the
+	// files changed since some git ref.  Paths are compared after
+	// filepath.Clean.
+	OnlySourcePaths []string
+
+	// DetectOrphans also reports live objects that are tagged with
+	// GcTag but absent from config, as `kubecfg update` would
+	// garbage collect them.  Requires Client and Discovery.
+	DetectOrphans bool
+	// GcTag is the garbage collection tag, see UpdateCmd.GcTag
+	GcTag string
+
+	// IncludeDependents also shows, after each object found on
+	// the server, the live objects that it owns (directly or
+	// indirectly, per their ownerReferences), eg: a Deployment's
+	// ReplicaSets and Pods.  They are informational only, and
+	// don't count as differences.  Requires Client and
+	// Discovery.
+	IncludeDependents bool
+
+	// ShowCreateBody shows the whole of each object that doesn't
+	// exist on the server, as added lines, prepared (and redacted)
+	// as for a diff.
+	ShowCreateBody bool
+
+	// DeletionPreview diffs each object as if it were removed
+	// from config, showing the whole of its live version as
+	// deleted lines.  Objects that don't exist on the server are
+	// unchanged.  Can't be used with Against.
+	DeletionPreview bool
+
+	// Order is the order objects are diffed and shown in,
+	// DiffOrderAlpha (the default if empty) or DiffOrderApply.
+	// DiffOrderApply requires Discovery.
+	Order string
+	// GroupByKind shows objects of the same kind together, in
+	// Order within each group, after a header naming the kind and
+	// its number of objects, eg: "=== Deployments (3) ===".  Groups
+	// are alphabetical by kind, or in order of their first object
+	// with DiffOrderApply.  Objects not in config come last, under
+	// a header of their own.  Not shown with OutputDir.
+	GroupByKind bool
+
+	// Filter restricts the output to objects that would be
+	// created (DiffFilterCreated) or changed (DiffFilterChanged).
+	// Errors are always shown.  Empty means DiffFilterAll.
+	Filter string
+
+	// MaxObjectBytes, if positive, is the largest serialized live
+	// or config object to diff.  Larger objects that differ are
+	// reported with their change in size only, since the diff
+	// itself can take excessive time and memory.
+	MaxObjectBytes int
+	// MaxValueLen, if positive, is the most characters of each
+	// string value to show, eg: of a long annotation.  Longer
+	// values are cut short with a note of their length, and marked
+	// as changed if live and config differ only past the cut.
+	MaxValueLen int
+	// DiffTimeout bounds the time spent computing each object's
+	// diff, after which a valid but less minimal diff is
+	// returned.  Zero keeps the library default (one second), and
+	// a negative value means no limit.
+	DiffTimeout time.Duration
+
+	// PreProcess, if set, is called on copies of both the live and
+	// config object just before they are serialized for diffing,
+	// after all other normalization and redaction.  It may modify
+	// the object in place, eg: to drop a label or sort a list.
+	PreProcess func(*unstructured.Unstructured) error
+
+	// NormalizeAPIVersion converts config objects to the version
+	// Mapper prefers for their kind before diffing, so objects
+	// written against a deprecated but equivalent version (eg:
+	// apps/v1beta1) don't all show an apiVersion change.
+	NormalizeAPIVersion bool
+
+	// HunkPaths labels each run of changed lines with the path of
+	// the field it starts in, eg: "@@ spec.replicas @@", after the
+	// hunk header if Context is not negative.  Only supported with
+	// JSON serialization.
+	HunkPaths bool
+
+	// KeepServerMetadata includes the metadata fields populated by
+	// the server (see serverMetadataFields) in the diff.  By
+	// default they are removed, since config never sets them.
+	KeepServerMetadata bool
+
+	// KeepManagedFields includes metadata.managedFields, the
+	// server's record of field ownership, in the diff.  By
+	// default it is removed from both live and config (it can
+	// still be shown with ShowManagers).
+	KeepManagedFields bool
+
+	// WarnImmutable warns about changes to well-known immutable
+	// fields (see immutableFields), eg: a Deployment's
+	// spec.selector, which the server would reject on update.
+	WarnImmutable bool
+
+	// Validate checks each config object against the server's
+	// OpenAPI schema, and warns of any errors, eg: unknown fields
+	// such as a misspelt spec.replicas, alongside its diff.
+	// Objects of kinds without a schema aren't checked.  Requires
+	// Discovery.
+	Validate bool
+
+	// StrictCRD fails the diff, listing the kinds, if any config
+	// object not found on the server is of a kind the server
+	// doesn't serve (eg: its CRD isn't installed), rather than
+	// showing it as created.  Requires Discovery.
+	StrictCRD bool
+
+	// ReportConflicts reports whatever conflict (HTTP 409) the
+	// DiffStrategyServer dry run patch returns, eg: a stale
+	// resourceVersion, in place of the diff, rather than failing.
+	// The object counts as changed.  Which manager owns a field
+	// needs server-side apply, which this client doesn't support.
+	ReportConflicts bool
+
+	// EqualityFunc, if set, is called with the live and config
+	// objects as they are about to be diffed (see PreProcess).  If
+	// it returns true, the object is reported unchanged whatever
+	// their differences.  Otherwise, and by default, an object is
+	// unchanged only if both serialize to exactly the same text,
+	// so eg: a nil and an empty list differ, but numbers that are
+	// equal (1 and 1.0) don't.
+	EqualityFunc func(live, config *unstructured.Unstructured) bool
+
+	// ManagedAnnotations are annotations maintained by tools
+	// rather than written in config, to remove from both live and
+	// config before diffing in every strategy.  nil means
+	// DefaultManagedAnnotations; use an empty list to diff them
+	// all.
+	ManagedAnnotations []string
+
+	// OutputDir, if set, is a directory to write each object's
+	// diff to, as <namespace>_<kind>_<name>.diff, instead of out.
+	// Cluster-scoped objects have no namespace, and kinds outside
+	// the core group are qualified by it (eg: Deployment.apps).
+	// Objects that aren't shown (see Quiet and Filter) or are
+	// unchanged get no file.  An index.txt listing the status and
+	// file of each written diff is created alongside.
+	OutputDir string
+
+	// manifests, set by DiffManifests, are the objects diffed
+	// against.  Those not matched are shown as deleted in place of
+	// orphans.
+	manifests *FileLiveSource
+}
+
+// DiffTarget is a cluster to diff against, see DiffCmd.Targets.
+type DiffTarget struct {
+	// Name labels this target in the output, eg: the kubeconfig
+	// context name
+	Name      string
+	Client    dynamic.Interface
+	Mapper    meta.RESTMapper
+	Discovery discovery.DiscoveryInterface
+}
+
+// DiffSink is an extra destination for diff output, see
+// DiffCmd.Sinks.
+type DiffSink struct {
+	Writer io.Writer
+	// Color is as DiffCmd.Color, for output to Writer
+	Color string
+}
+
+// DiffStatus describes how a config object compares to its live
+// counterpart.
+type DiffStatus string
+
+const (
+	// DiffStatusCreated means the object doesn't exist on the server
+	DiffStatusCreated DiffStatus = "created"
+	// DiffStatusChanged means the live object differs from config
+	DiffStatusChanged DiffStatus = "changed"
+	// DiffStatusUnchanged means the live object matches config
+	DiffStatusUnchanged DiffStatus = "unchanged"
+	// DiffStatusError means the object could not be diffed, see
+	// DiffCmd.ContinueOnError
+	DiffStatusError DiffStatus = "error"
+	// DiffStatusOrphaned means a live object is absent from
+	// config, and would be garbage collected, see
+	// DiffCmd.DetectOrphans.  With DiffManifests, the object is
+	// only in the first set.
+	DiffStatusOrphaned DiffStatus = "orphaned"
+)
+
+// ObjectDiff records the outcome of diffing a single config object.
+type ObjectDiff struct {
+	GroupVersionKind schema.GroupVersionKind
+	Namespace        string
+	Name             string
+	Status           DiffStatus
+	// Error is set when Status is DiffStatusError
+	Error error
+	// Added and Removed count the lines inserted and deleted by
+	// the diff, when Status is DiffStatusChanged
+	Added, Removed int
+	// Target is the name of the DiffTarget diffed against, if any
+	Target string
+	// Immutable lists the immutable fields changed, with
+	// DiffCmd.WarnImmutable
+	Immutable []string
+	// Invalid lists the schema validation errors in the config
+	// object, with DiffCmd.Validate
+	Invalid []error
+	// NoSchema is set if the DiffStrategyThreeWay merge was done
+	// without a schema for the object's kind (eg: a CRD), as a
+	// JSON merge patch, so the server's result may differ
+	NoSchema bool
+	// Hash is the fingerprint of the config object with
+	// DiffCmd.ShowHash: the first 12 hex digits of the sha256 of
+	// its JSON serialization, with map keys sorted
+	Hash string
+	// Merged is the result of merging config into the live object,
+	// as diffed, with the DiffStrategyThreeWay and
+	// DiffStrategyServer strategies, eg: for an apply to reuse.
+	// It isn't set for diffs found in DiffCmd.Cache.
+	Merged *unstructured.Unstructured
+	// Conflicts lists the conflicts the server returned for the
+	// dry run, with DiffCmd.ReportConflicts
+	Conflicts []DiffConflict
+}
+
+// DiffConflict is a conflict the server returned for a dry run
+// patch, see DiffCmd.ReportConflicts.
+type DiffConflict struct {
+	// Field is the path of the field, if the server named one, eg:
+	// .spec.replicas
+	Field string
+	// Message is the server's explanation, as returned
+	Message string
+}
+
+// DiffResult summarises the outcome of a DiffCmd run, with one
+// entry per config object in the order they were diffed.
+type DiffResult struct {
+	Objects []ObjectDiff
+
+	// configs holds the config object of each of Objects, or nil
+	// for orphans
+	configs []*unstructured.Unstructured
+}
+
+// SelectObjects returns the config objects diffed as the Objects at
+// the given indices, eg: to apply only the objects chosen after
+// reviewing the diff.  Indices that are out of range, or of orphaned
+// objects (which have no config), are skipped.
+func (r *DiffResult) SelectObjects(indices []int) []*unstructured.Unstructured {
+	var objs []*unstructured.Unstructured
+	for _, i := range indices {
+		if i >= 0 && i < len(r.configs) && r.configs[i] != nil {
+			objs = append(objs, r.configs[i])
+		}
+	}
+	return objs
+}
+
+// diffFoundError returns the kind of ErrDiffFound for r.
+func (r *DiffResult) diffFoundError() error {
+	if r.Count(DiffStatusChanged)+r.Count(DiffStatusOrphaned) > 0 {
+		return ErrModifications
+	}
+	return ErrCreatesOnly
+}
+
+// Count returns the number of objects with the given status.
+func (r *DiffResult) Count(status DiffStatus) int {
+	n := 0
+	for _, o := range r.Objects {
+		if o.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Run executes the diff command.  It returns ErrDiffFound (see
+// ErrCreatesOnly) if any object differs from the server, unless
+// ErrorOnDiff is false.
+func (c DiffCmd) Run(apiObjects []*unstructured.Unstructured, out io.Writer) error {
+	return c.RunContext(context.Background(), apiObjects, out)
+}
+
+// RunContext is like Run, but gives up waiting for the server and
+// returns ctx.Err() once ctx is done.
+func (c DiffCmd) RunContext(ctx context.Context, apiObjects []*unstructured.Unstructured, out io.Writer) error {
+	_, err := c.DiffContext(ctx, apiObjects, out)
+	return err
+}
+
+// Diff is like Run, but also returns a summary of the per-object
+// results.  The summary is returned even when err is ErrDiffFound.
+func (c DiffCmd) Diff(apiObjects []*unstructured.Unstructured, out io.Writer) (*DiffResult, error) {
+	return c.DiffContext(context.Background(), apiObjects, out)
+}
+
+// DiffContext is like Diff, with a context as for RunContext.
+func (c DiffCmd) DiffContext(ctx context.Context, apiObjects []*unstructured.Unstructured, out io.Writer) (*DiffResult, error) {
+	apiObjects, sourcePaths, err := c.flattenLists(apiObjects)
+	if err != nil {
+		return nil, err
+	}
+	c.SourcePaths = sourcePaths
+	if err := c.validateObjects(apiObjects); err != nil {
+		return nil, err
+	}
+	if c.Pager != "" && c.istty(out) {
+		return c.page(ctx, apiObjects, out)
+	}
+	if len(c.Sinks) > 0 {
+		return c.diffSinks(ctx, apiObjects, out)
+	}
+	if len(c.Targets) > 0 {
+		return c.diffTargets(ctx, apiObjects, out)
+	}
+
+	switch c.Layout {
+	case "", DiffLayoutUnified, DiffLayoutSideBySide:
+	default:
+		return nil, fmt.Errorf("Unknown diff layout %q", c.Layout)
+	}
+	if c.Width == 0 {
+		c.Width = terminalWidth(out)
+	}
+	switch c.Format {
+	case "", DiffFormatText, DiffFormatHTML, DiffFormatNames:
+	default:
+		return nil, fmt.Errorf("Unknown diff format %q", c.Format)
+	}
+	switch c.Color {
+	case "", DiffColorAuto, DiffColorAlways, DiffColorNever:
+	default:
+		return nil, fmt.Errorf("Unknown diff color setting %q", c.Color)
+	}
+	switch c.Granularity {
+	case "", DiffGranularityLine, DiffGranularityWord:
+	default:
+		return nil, fmt.Errorf("Unknown diff granularity %q", c.Granularity)
+	}
+	switch c.Filter {
+	case "", DiffFilterAll, DiffFilterCreated, DiffFilterChanged:
+	default:
+		return nil, fmt.Errorf("Unknown diff filter %q", c.Filter)
+	}
+	if c.DetectOrphans && (c.GcTag == "" || c.Client == nil || c.Discovery == nil) {
+		return nil, fmt.Errorf("Detecting orphans requires a server and a gc tag")
+	}
+	if c.IgnoreServerDefaults && !c.Offline && c.Discovery == nil {
+		return nil, fmt.Errorf("Ignoring server defaults requires a server")
+	}
+	if c.StrictCRD && (c.Offline || c.Discovery == nil) {
+		return nil, fmt.Errorf("Strict CRD checks require a server")
+	}
+	if c.Validate && (c.Offline || c.Discovery == nil) {
+		return nil, fmt.Errorf("Validating objects requires a server")
+	}
+	if c.IncludeDependents && (c.Offline || c.Client == nil || c.Discovery == nil) {
+		return nil, fmt.Errorf("Including dependents requires a server")
+	}
+	switch c.Order {
+	case "", DiffOrderAlpha:
+	case DiffOrderApply:
+		if c.Discovery == nil {
+			return nil, fmt.Errorf("The %s order requires a server", DiffOrderApply)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown diff order %q", c.Order)
+	}
+	switch c.Against {
+	case "", AgainstPreviousAnnotation:
+	default:
+		return nil, fmt.Errorf("Unknown diff against %q", c.Against)
+	}
+	if c.DeletionPreview && c.Against != "" {
+		return nil, fmt.Errorf("Deletion previews can't be diffed against %q", c.Against)
+	}
+	switch c.PatchFormat {
+	case "", PatchFormatUpdate, PatchFormatJSON:
+	default:
+		return nil, fmt.Errorf("Unknown patch format %q", c.PatchFormat)
+	}
+	if c.OutputDir != "" {
+		if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	switch c.Serialization {
+	case "", "json", "yaml":
+	default:
+		return nil, fmt.Errorf("Unknown diff serialization %q", c.Serialization)
+	}
+	switch c.SecretRedactMode {
+	case "", SecretRedactValues, SecretRedactFull:
+	default:
+		return nil, fmt.Errorf("Unknown secret redact mode %q", c.SecretRedactMode)
+	}
+	if strings.Trim(c.Indent, " \t") != "" {
+		return nil, fmt.Errorf("Invalid indent %q, must be spaces or tabs", c.Indent)
+	}
+	for _, path := range c.IgnorePaths {
+		if _, err := parseFieldPath(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Offline {
+		if c.LiveSource != nil || c.FromFile != "" || c.DetectOrphans || c.Order == DiffOrderApply {
+			return nil, fmt.Errorf("Offline diffs can't use a live source, orphan detection or apply order")
+		}
+		c.LiveSource = emptyLiveSource{}
+		c.ShowCreateBody = true
+	}
+
+	source := c.LiveSource
+	if source == nil && c.FromFile != "" {
+		var err error
+		source, err = NewFileLiveSource(c.FromFile, c.DefaultNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if source == nil {
+		source = &ClusterLiveSource{
+			Client:           c.Client,
+			Mapper:           c.Mapper,
+			DefaultNamespace: c.DefaultNamespace,
+			MatchBy:          c.MatchBy,
+		}
+	}
+
+	// Matched against every config object, so those filtered out
+	// below aren't removed
+	var removed []*unstructured.Unstructured
+	if c.manifests != nil {
+		removed, err = c.filterObjects(c.manifests.unmatched(apiObjects))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.OnlySourcePaths != nil {
+		apiObjects = c.sourceObjects(apiObjects)
+	}
+	apiObjects, err = c.filterObjects(apiObjects)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.NormalizeAPIVersion && c.Mapper != nil {
+		apiObjects = normalizeAPIVersions(c.Mapper, apiObjects)
+	}
+
+	if c.Order == DiffOrderApply {
+		depOrder, err := utils.DependencyOrder(c.Discovery, c.Mapper, apiObjects)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(depOrder)
+	} else {
+		sort.Sort(utils.AlphabeticalOrder(apiObjects))
+	}
+	if c.GroupByKind {
+		groupByKind(apiObjects, c.Order != DiffOrderApply)
+	}
+
+	var schemaResources openapi.Resources
+	if !c.Offline && c.Discovery != nil && (c.IgnoreServerDefaults || c.usesSchema(apiObjects)) {
+		var err error
+		schemaResources, err = c.loadSchema()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	liveObjs, fetchErrs, fetchTimes := c.fetchLive(ctx, source, apiObjects)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !c.ContinueOnError {
+		// Report the first error in apiObjects order, for consistency
+		for _, err := range fetchErrs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.StrictCRD {
+		missing, err := c.missingKinds(apiObjects, liveObjs, fetchErrs)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("Kinds unknown to the server, are CRDs missing? %s", strings.Join(missing, ", "))
+		}
+	}
+
+	var owned map[types.UID][]*unstructured.Unstructured
+	if c.IncludeDependents {
+		var err error
+		owned, err = c.listOwned()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DiffResult{}
+	diffFound := false
+	var index []outputFile
+	// With c.GroupByKind, the shown reports of the current kind,
+	// written under their header once all are known
+	var group []objectReport
+	flushGroup := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+		fmt.Fprintf(out, "=== %s (%d) ===\n", pluralKind(group[0].GroupVersionKind.Kind), len(group))
+		for _, report := range group {
+			if err := c.writeObject(out, report, &index); err != nil {
+				return err
+			}
+		}
+		group = nil
+		return nil
+	}
+	var errs []error
+	if c.MatchBy != "" {
+		// Matched objects are named below
+		apiObjects = append([]*unstructured.Unstructured(nil), apiObjects...)
+	}
+	for i, obj := range apiObjects {
+		liveObj := liveObjs[i]
+		if obj.GetName() == "" && liveObj != nil {
+			// Matched with c.MatchBy
+			obj = obj.DeepCopy()
+			obj.SetName(liveObj.GetName())
+			apiObjects[i] = obj
+		}
+		desc := c.describe(obj)
+
+		objDiff := ObjectDiff{
+			GroupVersionKind: obj.GroupVersionKind(),
+			Namespace:        obj.GetNamespace(),
+			Name:             obj.GetName(),
+		}
+
+		report := objectReport{desc: desc, namespace: c.effectiveNamespace(obj)}
+		err := fetchErrs[i]
+		var diffTime time.Duration
+		if err == nil && liveObj != nil && c.DeletionPreview {
+			report.diff, err = c.forObject(obj).diffObjects(liveObj, nil, schemaResources)
+			if err != nil {
+				err = fmt.Errorf("Error diffing %s: %v", desc, err)
+				if !c.ContinueOnError {
+					return nil, err
+				}
+			}
+		} else if err == nil && liveObj == nil && c.ShowCreateBody && !c.DeletionPreview {
+			report.diff, err = c.forObject(obj).diffObjects(nil, obj, schemaResources)
+			if err != nil {
+				err = fmt.Errorf("Error diffing %s: %v", desc, err)
+				if !c.ContinueOnError {
+					return nil, err
+				}
+			}
+		}
+		if err == nil && liveObj != nil && !c.DeletionPreview {
+			start := time.Now()
+			oc := c.forObject(obj)
+			from, to := liveObj, obj
+			if c.Against == AgainstPreviousAnnotation {
+				oc = c.againstPrevious()
+				to = liveObj
+				from, err = previousVersion(liveObj)
+				report.noPrevious = err == nil && from == nil
+			}
+			if err == nil && !report.noPrevious {
+				var cacheKey string
+				if c.Cache != nil && c.Against == "" {
+					cacheKey = diffCacheKey(oc.DiffStrategy, liveObj, obj)
+				}
+				cached := false
+				if cacheKey != "" {
+					report.diff, cached = c.Cache.Get(cacheKey)
+				}
+				if !cached {
+					report.diff, objDiff.Merged, err = oc.diffMerged(from, to, schemaResources)
+					if err == nil && cacheKey != "" {
+						c.Cache.Set(cacheKey, report.diff)
+					}
+				}
+				objDiff.NoSchema = oc.DiffStrategy == DiffStrategyThreeWay && kindSchema(schemaResources, to) == nil
+			}
+			if tooLarge, ok := err.(*objectTooLargeError); ok {
+				report.tooLarge = tooLarge
+				err = nil
+			}
+			if c.ReportConflicts && errors.IsConflict(err) {
+				objDiff.Conflicts = conflictFields(err)
+				err = nil
+			}
+			if err == nil && c.EmitPatch && c.Against == "" && !isEmptyDiff(report.diff) {
+				err = oc.addPatch(&report, liveObj, obj, schemaResources)
+			}
+			diffTime = time.Since(start)
+			if err != nil {
+				err = fmt.Errorf("Error diffing %s: %v", desc, err)
+				if !c.ContinueOnError {
+					return nil, err
+				}
+			}
+		}
+
+		switch {
+		case err != nil:
+			objDiff.Status = DiffStatusError
+			objDiff.Error = err
+			errs = append(errs, err)
+		case c.DeletionPreview && liveObj == nil:
+			objDiff.Status = DiffStatusUnchanged
+		case c.DeletionPreview:
+			objDiff.Status = DiffStatusOrphaned
+			objDiff.Added, objDiff.Removed = diffStat(report.diff)
+			diffFound = true
+		case liveObj == nil:
+			objDiff.Status = DiffStatusCreated
+			diffFound = true
+		case report.tooLarge != nil, len(objDiff.Conflicts) > 0:
+			objDiff.Status = DiffStatusChanged
+			diffFound = true
+		case isEmptyDiff(report.diff):
+			objDiff.Status = DiffStatusUnchanged
+		default:
+			objDiff.Status = DiffStatusChanged
+			objDiff.Added, objDiff.Removed = diffStat(report.diff)
+			diffFound = true
+		}
+		if c.WarnImmutable && c.Against == "" && objDiff.Status == DiffStatusChanged {
+			objDiff.Immutable = immutableChanges(liveObj, obj)
+		}
+		if c.Validate && objDiff.Status != DiffStatusError {
+			objDiff.Invalid = validateObject(obj, schemaResources)
+		}
+		if c.ShowHash {
+			objDiff.Hash = objectHash(obj)
+		}
+		result.Objects = append(result.Objects, objDiff)
+		result.configs = append(result.configs, obj)
+		if c.OnObject != nil {
+			changed := objDiff.Status == DiffStatusChanged || objDiff.Status == DiffStatusCreated || objDiff.Status == DiffStatusOrphaned
+			c.OnObject(obj, changed, report.diff)
+		}
+		log.WithFields(log.Fields{
+			"kind":          objDiff.GroupVersionKind.Kind,
+			"namespace":     objDiff.Namespace,
+			"name":          objDiff.Name,
+			"fetchDuration": fetchTimes[i],
+			"diffDuration":  diffTime,
+			"changed":       objDiff.Status == DiffStatusChanged || objDiff.Status == DiffStatusCreated,
+		}).Debug("Diffed object")
+
+		report.ObjectDiff = objDiff
+		if liveObj != nil && owned != nil {
+			report.dependents = dependents(liveObj, owned)
+		}
+		if c.GroupByKind && c.OutputDir == "" {
+			if len(group) > 0 && group[0].GroupVersionKind.GroupKind() != objDiff.GroupVersionKind.GroupKind() {
+				if err := flushGroup(); err != nil {
+					return nil, err
+				}
+			}
+			if c.shown(objDiff) {
+				group = append(group, report)
+			}
+			continue
+		}
+		if err := c.writeObject(out, report, &index); err != nil {
+			return nil, err
+		}
+	}
+	if err := flushGroup(); err != nil {
+		return nil, err
+	}
+
+	orphans := removed
+	if c.DetectOrphans {
+		orphans, err = c.findOrphans(apiObjects)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.GroupByKind && c.OutputDir == "" && len(orphans) > 0 && c.shown(ObjectDiff{Status: DiffStatusOrphaned}) {
+		fmt.Fprintf(out, "=== Not in config (%d) ===\n", len(orphans))
+	}
+	for _, obj := range orphans {
+		report := objectReport{
+			ObjectDiff: ObjectDiff{
+				GroupVersionKind: obj.GroupVersionKind(),
+				Namespace:        obj.GetNamespace(),
+				Name:             obj.GetName(),
+				Status:           DiffStatusOrphaned,
+			},
+			desc:      c.describe(obj),
+			namespace: obj.GetNamespace(),
+		}
+		report.diff, err = c.diffObjects(obj, nil, schemaResources)
+		if err != nil {
+			return nil, fmt.Errorf("Error diffing %s: %v", report.desc, err)
+		}
+		result.Objects = append(result.Objects, report.ObjectDiff)
+		result.configs = append(result.configs, nil)
+		diffFound = true
+		if c.OnObject != nil {
+			c.OnObject(obj, true, report.diff)
+		}
+		if err := c.writeObject(out, report, &index); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.OutputDir != "" {
+		if err := c.writeIndex(index); err != nil {
+			return nil, err
+		}
+	}
+	if c.Summary {
+		printSummary(out, result)
+	}
+	if c.Status != nil {
+		if err := writeStatus(c.Status, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, utilerrors.NewAggregate(errs)
+	}
+	if diffFound && (c.ErrorOnDiff == nil || *c.ErrorOnDiff) {
+		return result, result.diffFoundError()
+	}
+	return result, nil
+}
+
+// page runs the diff with its output piped through c.Pager, which
+// writes to out.  Colors and width are still chosen for out.
+func (c DiffCmd) page(ctx context.Context, apiObjects []*unstructured.Unstructured, out io.Writer) (*DiffResult, error) {
+	if c.useColor(out) {
+		c.Color = DiffColorAlways
+	} else {
+		c.Color = DiffColorNever
+	}
+	if c.Width == 0 {
+		c.Width = terminalWidth(out)
+	}
+
+	command := c.Pager
+	pager := exec.Command("sh", "-c", command)
+	pager.Stdout = out
+	pager.Stderr = os.Stderr
+	w, err := pager.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := pager.Start(); err != nil {
+		return nil, fmt.Errorf("Error starting pager %q: %v", command, err)
+	}
+
+	c.Pager = ""
+	result, err := c.DiffContext(ctx, apiObjects, w)
+	w.Close()
+	if waitErr := pager.Wait(); waitErr != nil && err == nil {
+		err = fmt.Errorf("Error running pager %q: %v", command, waitErr)
+	}
+	return result, err
+}
+
+// diffSinks runs the diff once, and writes its output to out and
+// each of c.Sinks.  The output is rendered with colors if any writer
+// wants them, and stripped of them for the others.
+func (c DiffCmd) diffSinks(ctx context.Context, apiObjects []*unstructured.Unstructured, out io.Writer) (*DiffResult, error) {
+	sinks := append([]DiffSink{{Writer: out, Color: c.Color}}, c.Sinks...)
+	colors := make([]bool, len(sinks))
+	anyColor := false
+	for i, sink := range sinks {
+		switch sink.Color {
+		case "", DiffColorAuto, DiffColorAlways, DiffColorNever:
+		default:
+			return nil, fmt.Errorf("Unknown diff color setting %q", sink.Color)
+		}
+		colors[i] = DiffCmd{Color: sink.Color}.useColor(sink.Writer)
+		anyColor = anyColor || colors[i]
+	}
+	if anyColor {
+		c.Color = DiffColorAlways
+	} else {
+		c.Color = DiffColorNever
+	}
+	if c.Width == 0 {
+		c.Width = terminalWidth(out)
+	}
+
+	c.Sinks = nil
+	var buf bytes.Buffer
+	result, err := c.DiffContext(ctx, apiObjects, &buf)
+	plain := buf.Bytes()
+	if anyColor {
+		plain = ansiEscape.ReplaceAll(plain, nil)
+	}
+	for i, sink := range sinks {
+		text := plain
+		if colors[i] {
+			text = buf.Bytes()
+		}
+		if _, werr := sink.Writer.Write(text); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return result, err
+}
+
+// ansiEscape matches the escape sequences of ansiMarkup
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// diffTargets diffs apiObjects against each of c.Targets in turn,
+// followed by a summary of the results for each object.
+func (c DiffCmd) diffTargets(ctx context.Context, apiObjects []*unstructured.Unstructured, out io.Writer) (*DiffResult, error) {
+	if c.LiveSource != nil || c.FromFile != "" || c.Offline {
+		return nil, fmt.Errorf("Diff targets can't be combined with another live source")
+	}
+
+	result := &DiffResult{}
+	var errs []error
+	for _, target := range c.Targets {
+		tc := c
+		tc.Targets, tc.Status = nil, nil
+		tc.Client, tc.Mapper, tc.Discovery = target.Client, target.Mapper, target.Discovery
+
+		fmt.Fprintf(out, "=== %s\n", target.Name)
+		r, err := tc.DiffContext(ctx, apiObjects, out)
+		if err != nil && !goerrors.Is(err, ErrDiffFound) {
+			err = fmt.Errorf("%s: %v", target.Name, err)
+			if r == nil {
+				return nil, err
+			}
+			// Continuing on error
+			errs = append(errs, err)
+		}
+		for i, obj := range r.Objects {
+			obj.Target = target.Name
+			result.Objects = append(result.Objects, obj)
+			result.configs = append(result.configs, r.configs[i])
+		}
+	}
+
+	printTargetSummary(out, result)
+	if c.Status != nil {
+		if err := writeStatus(c.Status, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, utilerrors.NewAggregate(errs)
+	}
+	diffFound := result.Count(DiffStatusCreated)+result.Count(DiffStatusChanged)+result.Count(DiffStatusOrphaned) > 0
+	if diffFound && (c.ErrorOnDiff == nil || *c.ErrorOnDiff) {
+		return result, result.diffFoundError()
+	}
+	return result, nil
+}
+
+// printSummary writes the number of objects in result by status.
+func printSummary(out io.Writer, result *DiffResult) {
+	fmt.Fprintf(out, "Summary: %d objects, %d changed, %d to create, %d unchanged",
+		len(result.Objects), result.Count(DiffStatusChanged), result.Count(DiffStatusCreated), result.Count(DiffStatusUnchanged))
+	if n := result.Count(DiffStatusOrphaned); n > 0 {
+		fmt.Fprintf(out, ", %d to garbage collect", n)
+	}
+	if n := result.Count(DiffStatusError); n > 0 {
+		fmt.Fprintf(out, ", %d errors", n)
+	}
+	fmt.Fprintln(out)
+}
+
+// writeStatus writes the number of objects in result by status to w,
+// as a line of JSON, see DiffCmd.Status.
+func writeStatus(w io.Writer, result *DiffResult) error {
+	status := struct {
+		Changed   int `json:"changed"`
+		Created   int `json:"created"`
+		Unchanged int `json:"unchanged"`
+		Orphaned  int `json:"orphaned"`
+		Errors    int `json:"errors"`
+	}{
+		Changed:   result.Count(DiffStatusChanged),
+		Created:   result.Count(DiffStatusCreated),
+		Unchanged: result.Count(DiffStatusUnchanged),
+		Orphaned:  result.Count(DiffStatusOrphaned),
+		Errors:    result.Count(DiffStatusError),
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// printTargetSummary writes one line per object, with its status in
+// each target.
+func printTargetSummary(out io.Writer, result *DiffResult) {
+	type key struct {
+		gvk             schema.GroupVersionKind
+		namespace, name string
+	}
+	var order []key
+	statuses := map[key][]string{}
+	for _, obj := range result.Objects {
+		k := key{obj.GroupVersionKind, obj.Namespace, obj.Name}
+		if _, ok := statuses[k]; !ok {
+			order = append(order, k)
+		}
+		statuses[k] = append(statuses[k], fmt.Sprintf("%s=%s", obj.Target, obj.Status))
+	}
+
+	fmt.Fprintln(out, "=== Summary")
+	for _, k := range order {
+		desc := k.gvk.Kind + "/" + k.name
+		if k.namespace != "" {
+			desc = k.gvk.Kind + "/" + k.namespace + "/" + k.name
+		}
+		fmt.Fprintf(out, "%s: %s\n", desc, strings.Join(statuses[k], " "))
+	}
+}
+
+// findOrphans returns the live objects eligible for garbage
+// collection with c.GcTag that aren't in objs, in alphabetical order.
+func (c DiffCmd) findOrphans(objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	key := func(gk schema.GroupKind, ns, name string) string {
+		return fmt.Sprintf("%s/%s/%s", gk, ns, name)
+	}
+	inConfig := map[string]bool{}
+	for _, obj := range objs {
+		inConfig[key(obj.GroupVersionKind().GroupKind(), c.effectiveNamespace(obj), obj.GetName())] = true
+	}
+
+	var orphans []*unstructured.Unstructured
+	err := walkObjects(c.Client, c.Discovery, metav1.ListOptions{}, func(o runtime.Object) error {
+		obj, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			return fmt.Errorf("Unexpected object type %T", o)
+		}
+		if eligibleForGc(obj, c.GcTag) && !inConfig[key(obj.GroupVersionKind().GroupKind(), obj.GetNamespace(), obj.GetName())] {
+			orphans = append(orphans, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(utils.AlphabeticalOrder(orphans))
+	return orphans, nil
+}
+
+// listOwned returns every live object that has an owner, by the UID
+// of each of its owners.
+func (c DiffCmd) listOwned() (map[types.UID][]*unstructured.Unstructured, error) {
+	owned := map[types.UID][]*unstructured.Unstructured{}
+	err := walkObjects(c.Client, c.Discovery, metav1.ListOptions{}, func(o runtime.Object) error {
+		obj, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			return fmt.Errorf("Unexpected object type %T", o)
+		}
+		for _, ref := range obj.GetOwnerReferences() {
+			owned[ref.UID] = append(owned[ref.UID], obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, objs := range owned {
+		sort.Sort(utils.AlphabeticalOrder(objs))
+	}
+	return owned, nil
+}
+
+// dependents returns the objects owned by obj, directly or
+// indirectly, depth first.
+func dependents(obj *unstructured.Unstructured, owned map[types.UID][]*unstructured.Unstructured) []*unstructured.Unstructured {
+	var result []*unstructured.Unstructured
+	seen := map[types.UID]bool{obj.GetUID(): true}
+	var walk func(uid types.UID)
+	walk = func(uid types.UID) {
+		for _, dep := range owned[uid] {
+			if seen[dep.GetUID()] {
+				continue
+			}
+			seen[dep.GetUID()] = true
+			result = append(result, dep)
+			walk(dep.GetUID())
+		}
+	}
+	if obj.GetUID() != "" {
+		walk(obj.GetUID())
+	}
+	return result
+}
+
+// againstPrevious returns c set up to diff previous versions of
+// objects with their live versions, see DiffCmd.Against.
+func (c DiffCmd) againstPrevious() DiffCmd {
+	c.DiffStrategy = "all"
+	managed := c.ManagedAnnotations
+	if managed == nil {
+		managed = DefaultManagedAnnotations
+	}
+	c.ManagedAnnotations = append(append([]string(nil), managed...), AnnotationPrevious)
+	return c
+}
+
+// previousVersion returns the object recorded in the
+// AnnotationPrevious annotation of obj, or nil if there isn't one.
+func previousVersion(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	text, ok := obj.GetAnnotations()[AnnotationPrevious]
+	if !ok {
+		return nil, nil
+	}
+	objs, err := utils.ParseObjects(strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s annotation: %v", AnnotationPrevious, err)
+	}
+	if len(objs) != 1 {
+		return nil, fmt.Errorf("Invalid %s annotation: found %d objects, expected one", AnnotationPrevious, len(objs))
+	}
+	return objs[0], nil
+}
+
+// validateObjects checks every object has an apiVersion, kind and
+// name (or c.MatchBy label), so they can be looked up on the server,
+// and c.DiffStrategy and any AnnotationDiffStrategy are known
+// strategies.
+func (c DiffCmd) validateObjects(objs []*unstructured.Unstructured) error {
+	var errs []error
+	if c.DiffStrategy != "" && !knownStrategy(c.DiffStrategy) {
+		errs = append(errs, fmt.Errorf("Unknown diff strategy %q", c.DiffStrategy))
+	}
+	kinds := make([]string, 0, len(c.StrategyByKind))
+	for kind := range c.StrategyByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if strategy := c.StrategyByKind[kind]; !knownStrategy(strategy) {
+			errs = append(errs, fmt.Errorf("Unknown diff strategy %q for %s", strategy, kind))
+		}
+	}
+	for i, obj := range objs {
+		var missing []string
+		if obj.GetAPIVersion() == "" {
+			missing = append(missing, "apiVersion")
+		}
+		if obj.GetKind() == "" {
+			missing = append(missing, "kind")
+		}
+		if obj.GetName() == "" {
+			if c.MatchBy == "" {
+				missing = append(missing, "name")
+			} else if _, ok := obj.GetLabels()[c.MatchBy]; !ok {
+				missing = append(missing, "name and "+c.MatchBy+" label")
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Errorf("Object %d is missing %s", i, strings.Join(missing, ", ")))
+		}
+		if strategy, ok := obj.GetAnnotations()[AnnotationDiffStrategy]; ok && !knownStrategy(strategy) {
+			errs = append(errs, fmt.Errorf("Object %d has unknown %s %q", i, AnnotationDiffStrategy, strategy))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// knownStrategy returns true if strategy is a diff strategy that can
+// be set globally, per kind or object.
+func knownStrategy(strategy string) bool {
+	switch strategy {
+	case "all", "subset", DiffStrategyThreeWay, DiffStrategyServer, DiffStrategySkip:
+		return true
+	}
+	return false
+}
+
+// flattenLists returns objs with any List (or eg: ConfigMapList)
+// replaced by its items, as kubectl does, so eg: the output of
+// `kubectl get -o yaml` can be diffed.  Items inherit the list's
+// c.SourcePaths entry, in the map returned.
+func (c DiffCmd) flattenLists(objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, map[*unstructured.Unstructured]string, error) {
+	hasList := false
+	for _, obj := range objs {
+		hasList = hasList || isList(obj)
+	}
+	if !hasList {
+		return objs, c.SourcePaths, nil
+	}
+
+	var sourcePaths map[*unstructured.Unstructured]string
+	if c.SourcePaths != nil {
+		sourcePaths = make(map[*unstructured.Unstructured]string, len(c.SourcePaths))
+		for obj, p := range c.SourcePaths {
+			sourcePaths[obj] = p
+		}
+	}
+	ret := make([]*unstructured.Unstructured, 0, len(objs))
+	var flatten func(obj *unstructured.Unstructured, source string, hasSource bool) error
+	flatten = func(obj *unstructured.Unstructured, source string, hasSource bool) error {
+		if !isList(obj) {
+			ret = append(ret, obj)
+			if hasSource {
+				sourcePaths[obj] = source
+			}
+			return nil
+		}
+		return obj.EachListItem(func(item runtime.Object) error {
+			u, ok := item.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("Unexpected item in %s", c.describe(obj))
+			}
+			return flatten(u, source, hasSource)
+		})
+	}
+	for _, obj := range objs {
+		source, hasSource := c.SourcePaths[obj]
+		if err := flatten(obj, source, hasSource); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ret, sourcePaths, nil
+}
+
+// isList returns true if obj is a List kind with items.
+func isList(obj *unstructured.Unstructured) bool {
+	return strings.HasSuffix(obj.GetKind(), "List") && obj.IsList()
+}
+
+// groupByKind stably sorts objs by kind, alphabetically or else in
+// order of each kind's first object.
+func groupByKind(objs []*unstructured.Unstructured, alpha bool) {
+	first := map[schema.GroupKind]int{}
+	for i, obj := range objs {
+		gk := obj.GroupVersionKind().GroupKind()
+		if _, ok := first[gk]; !ok {
+			first[gk] = i
+		}
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		a, b := objs[i].GroupVersionKind().GroupKind(), objs[j].GroupVersionKind().GroupKind()
+		if alpha && a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if alpha && a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return first[a] < first[b]
+	})
+}
+
+// pluralKind returns the English plural of kind, for headers.
+func pluralKind(kind string) string {
+	lower := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(lower, "ss"), strings.HasSuffix(lower, "x"), strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return kind + "es"
+	case strings.HasSuffix(lower, "s"):
+		// eg: Endpoints
+		return kind
+	case len(lower) > 1 && lower[len(lower)-1] == 'y' && !strings.ContainsRune("aeiou", rune(lower[len(lower)-2])):
+		return kind[:len(kind)-1] + "ies"
+	}
+	return kind + "s"
+}
+
+// filterObjects returns the objects selected by c.LabelSelector and
+// c.Namespaces, without those whose strategy is DiffStrategySkip.
+func (c DiffCmd) filterObjects(objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	if c.LabelSelector != "" {
+		selector, err := labels.Parse(c.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label selector %q: %v", c.LabelSelector, err)
+		}
+		objs = selectObjects(objs, selector)
+	}
+	if len(c.Namespaces) > 0 {
+		objs = c.namespaceObjects(objs)
+	}
+	return c.skipObjects(objs), nil
+}
+
+// skipObjects returns the objects whose strategy isn't
+// DiffStrategySkip.
+func (c DiffCmd) skipObjects(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	ret := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if c.forObject(obj).DiffStrategy == DiffStrategySkip {
+			log.Debugf("Skipping %s", c.describe(obj))
+			continue
+		}
+		ret = append(ret, obj)
+	}
+	return ret
+}
+
+// sourceObjects returns the objects read from c.OnlySourcePaths.
+func (c DiffCmd) sourceObjects(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	allowed := make(map[string]bool, len(c.OnlySourcePaths))
+	for _, p := range c.OnlySourcePaths {
+		allowed[filepath.Clean(p)] = true
+	}
+	ret := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		p, ok := c.SourcePaths[obj]
+		if !ok || !allowed[filepath.Clean(p)] {
+			log.Debugf("Skipping %s, not from a selected source file", c.describe(obj))
+			continue
+		}
+		ret = append(ret, obj)
+	}
+	return ret
+}
+
+// namespaceObjects returns the objects in c.Namespaces, and any
+// cluster-scoped objects with c.IncludeClusterScoped.
+func (c DiffCmd) namespaceObjects(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	allowed := make(map[string]bool, len(c.Namespaces))
+	for _, ns := range c.Namespaces {
+		allowed[ns] = true
+	}
+	ret := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		ns := c.effectiveNamespace(obj)
+		if (ns == "" && !c.IncludeClusterScoped) || (ns != "" && !allowed[ns]) {
+			log.Debugf("Skipping %s, not in an allowed namespace", c.describe(obj))
+			continue
+		}
+		ret = append(ret, obj)
+	}
+	return ret
+}
+
+// forObject returns c with DiffStrategy set for obj, see
+// StrategyByKind and AnnotationDiffStrategy.
+func (c DiffCmd) forObject(obj *unstructured.Unstructured) DiffCmd {
+	if strategy, ok := obj.GetAnnotations()[AnnotationDiffStrategy]; ok {
+		c.DiffStrategy = strategy
+	} else if strategy, ok := c.StrategyByKind[obj.GetKind()]; ok {
+		c.DiffStrategy = strategy
+	}
+	return c
+}
+
+// normalizeAPIVersions returns objs, with any object not already at
+// its preferred version according to mapper replaced by a copy at
+// that version.  Objects mapper doesn't know are left alone, to be
+// reported when they are fetched.
+func normalizeAPIVersions(mapper meta.RESTMapper, objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	ret := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind())
+		if err == nil && mapping.GroupVersionKind.Version != gvk.Version {
+			log.Debugf("Converting %s to %s", gvk, mapping.GroupVersionKind.GroupVersion())
+			obj = obj.DeepCopy()
+			obj.SetAPIVersion(mapping.GroupVersionKind.GroupVersion().String())
+		}
+		ret = append(ret, obj)
+	}
+	return ret
+}
+
+// selectObjects returns the objects whose labels match selector.
+func selectObjects(objs []*unstructured.Unstructured, selector labels.Selector) []*unstructured.Unstructured {
+	var result []*unstructured.Unstructured
+	for _, obj := range objs {
+		if selector.Matches(labels.Set(obj.GetLabels())) {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+// loadSchema fetches and parses the server's OpenAPI schema, via
+// c.SchemaCache if set.
+func (c DiffCmd) loadSchema() (openapi.Resources, error) {
+	var serverVersion string
+	if c.SchemaCache != nil {
+		info, err := c.Discovery.ServerVersion()
+		if err != nil {
+			log.Debugf("Not caching schema, as server version is unknown (%s)", err)
+		} else {
+			serverVersion = info.String()
+			if schema := c.SchemaCache.Get(serverVersion); schema != nil {
+				return schema, nil
+			}
+		}
+	}
+
+	schemaDoc, err := c.Discovery.OpenAPISchema()
+	if err != nil {
+		return nil, err
+	}
+	if !hasResourceSchemas(schemaDoc) {
+		// Seen with some managed clusters and minimal API servers
+		log.Warnf("Server's OpenAPI schema has no resource kinds, diffing without a schema")
+		return nil, nil
+	}
+	schema, err := openapi.NewOpenAPIData(schemaDoc)
+	if err != nil {
+		return nil, err
+	}
+	if serverVersion != "" {
+		c.SchemaCache.Set(serverVersion, schema)
+	}
+	return schema, nil
+}
+
+// groupVersionKindExtension marks the OpenAPI definitions of
+// resource kinds
+const groupVersionKindExtension = "x-kubernetes-group-version-kind"
+
+// hasResourceSchemas returns true if doc defines any resource kinds.
+func hasResourceSchemas(doc *openapi_v2.Document) bool {
+	for _, def := range doc.GetDefinitions().GetAdditionalProperties() {
+		for _, ext := range def.GetValue().GetVendorExtension() {
+			if ext.GetName() == groupVersionKindExtension {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SchemaCache stores parsed OpenAPI schemas between runs, by server
+// version.  See DiffCmd.SchemaCache.
+type SchemaCache interface {
+	// Get returns the schema for serverVersion, or nil if none
+	// is cached
+	Get(serverVersion string) openapi.Resources
+	Set(serverVersion string, schema openapi.Resources)
+}
+
+// MemorySchemaCache is a SchemaCache for the life of the process.
+// The zero value is empty and ready to use.
+type MemorySchemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]openapi.Resources
+}
+
+// Get implements SchemaCache
+func (m *MemorySchemaCache) Get(serverVersion string) openapi.Resources {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.schemas[serverVersion]
+}
+
+// Set implements SchemaCache
+func (m *MemorySchemaCache) Set(serverVersion string, schema openapi.Resources) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.schemas == nil {
+		m.schemas = map[string]openapi.Resources{}
+	}
+	m.schemas[serverVersion] = schema
+}
+
+// DiffCache stores the diffs of objects between runs, by a hash of
+// the config object and the live object's resourceVersion.  See
+// DiffCmd.Cache.
+type DiffCache interface {
+	// Get returns the diff cached for key, and whether there was
+	// one
+	Get(key string) ([]diffmatchpatch.Diff, bool)
+	Set(key string, diff []diffmatchpatch.Diff)
+}
+
+// MemoryDiffCache is a DiffCache for the life of the process.  The
+// zero value is empty and ready to use.
+type MemoryDiffCache struct {
+	mu    sync.Mutex
+	diffs map[string][]diffmatchpatch.Diff
+}
+
+// Get implements DiffCache
+func (m *MemoryDiffCache) Get(key string) ([]diffmatchpatch.Diff, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	diff, ok := m.diffs[key]
+	return diff, ok
+}
+
+// Set implements DiffCache
+func (m *MemoryDiffCache) Set(key string, diff []diffmatchpatch.Diff) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.diffs == nil {
+		m.diffs = map[string][]diffmatchpatch.Diff{}
+	}
+	m.diffs[key] = diff
+}
+
+// objectHash returns the fingerprint of obj, see ObjectDiff.Hash.
+func objectHash(obj *unstructured.Unstructured) string {
+	b, err := json.Marshal(obj.Object)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// diffCacheKey returns the DiffCache key for diffing live and config
+// with strategy, or "" if the diff can't be cached (eg: live has no
+// resourceVersion).
+func diffCacheKey(strategy string, live, config *unstructured.Unstructured) string {
+	rv := live.GetResourceVersion()
+	if rv == "" {
+		return ""
+	}
+	b, err := json.Marshal(config.Object)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", strategy, live.GetUID(), rv)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// useColor returns true if output to out should be colorized.
+func (c DiffCmd) useColor(out io.Writer) bool {
+	switch c.Color {
+	case DiffColorAlways:
+		return true
+	case DiffColorNever:
+		return false
+	}
+	// See https://no-color.org/
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	return c.istty(out)
+}
+
+// istty reports whether out is a terminal, honouring ForceTTY.
+func (c DiffCmd) istty(out io.Writer) bool {
+	if c.ForceTTY != nil {
+		return *c.ForceTTY
+	}
+	return istty(out)
+}
+
+// objectReport is everything printed about one object
+type objectReport struct {
+	ObjectDiff
+	desc string
+	diff []diffmatchpatch.Diff
+
+	// See DiffCmd.EmitPatch
+	patchType types.PatchType
+	patch     []byte
+	// Patch not shown, as it may contain sensitive values
+	patchRedacted bool
+
+	// Set in place of diff, see DiffCmd.MaxObjectBytes
+	tooLarge *objectTooLargeError
+
+	// See DiffCmd.IncludeDependents
+	dependents []*unstructured.Unstructured
+
+	// Live object has no previous version, see DiffCmd.Against
+	noPrevious bool
+
+	// Namespace the object is in, with DiffCmd.DefaultNamespace
+	// filled in, for its DiffCmd.OutputDir file
+	namespace string
+}
+
+// objectTooLargeError is returned by diffObjects for objects that
+// differ, but exceed DiffCmd.MaxObjectBytes.
+type objectTooLargeError struct {
+	liveSize, configSize int
+}
+
+func (e *objectTooLargeError) Error() string {
+	size := e.liveSize
+	if e.configSize > size {
+		size = e.configSize
+	}
+	return fmt.Sprintf("object too large to diff (%d bytes), showing size change only", size)
+}
+
+// validateObject returns the errors in obj according to its kind's
+// schema, if any.
+func validateObject(obj *unstructured.Unstructured, schema openapi.Resources) []error {
+	s := kindSchema(schema, obj)
+	if s == nil {
+		return nil
+	}
+	gvk := obj.GroupVersionKind()
+	return validation.ValidateModel(obj.UnstructuredContent(), s, fmt.Sprintf("%s.%s", gvk.Version, gvk.Kind))
+}
+
+// usesSchema returns true if c makes use of the OpenAPI schema, when
+// available, to diff objs.
+func (c DiffCmd) usesSchema(objs []*unstructured.Unstructured) bool {
+	if c.EmitPatch || c.Validate {
+		return true
+	}
+	strategies := []string{c.DiffStrategy}
+	for _, strategy := range c.StrategyByKind {
+		strategies = append(strategies, strategy)
+	}
+	for _, obj := range objs {
+		if strategy, ok := obj.GetAnnotations()[AnnotationDiffStrategy]; ok {
+			strategies = append(strategies, strategy)
+		}
+	}
+	for _, strategy := range strategies {
+		switch strategy {
+		case "subset", DiffStrategyThreeWay, DiffStrategyServer:
+			return true
+		}
+	}
+	return false
+}
+
+// addPatch records the patch `kubecfg update` would send to update
+// live to config in report.
+func (c DiffCmd) addPatch(report *objectReport, live, config *unstructured.Unstructured, schema openapi.Resources) error {
+	paths, err := c.sensitivePaths(live, config)
+	if err != nil {
+		return err
+	}
+	if paths != nil || (c.OmitSecrets && (config.GetKind() == "Secret" || hasSensitiveKey(live.Object) || hasSensitiveKey(config.Object))) {
+		report.patchRedacted = true
+		return nil
+	}
+
+	if c.PatchFormat == PatchFormatJSON {
+		target := config
+		switch c.DiffStrategy {
+		case DiffStrategyThreeWay:
+			target, err = patch(live, config, kindSchema(schema, config))
+		case DiffStrategyServer:
+			target, err = c.serverDryRun(live, config, schema)
+		}
+		if err != nil {
+			return err
+		}
+		report.patchType = types.JSONPatchType
+		report.patch, err = json.Marshal(jsonPatch([]jsonPatchOp{}, "", live.Object, target.Object))
+		return err
+	}
+
+	report.patchType, report.patch, err = createPatch(live, config, kindSchema(schema, config))
+	return err
+}
+
+// jsonPatchOp is an RFC 6902 JSON Patch operation
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// jsonPatch appends to ops the add, remove and replace operations
+// that transform from into to, at path (a JSON pointer).  Map keys
+// are visited in sorted order, so the result is deterministic.
+func jsonPatch(ops []jsonPatchOp, path string, from, to interface{}) []jsonPatchOp {
+	op := func(name, p string, v interface{}) jsonPatchOp {
+		ret := jsonPatchOp{Op: name, Path: p}
+		if name != "remove" {
+			// Values were decoded from JSON, so can't fail
+			ret.Value, _ = json.Marshal(v)
+		}
+		return ret
+	}
+
+	switch f := from.(type) {
+	case map[string]interface{}:
+		t, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(f)+len(t))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		for k := range t {
+			if _, ok := f[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + jsonPointerEscaper.Replace(k)
+			fv, inFrom := f[k]
+			tv, inTo := t[k]
+			switch {
+			case !inTo:
+				ops = append(ops, op("remove", p, nil))
+			case !inFrom:
+				ops = append(ops, op("add", p, tv))
+			default:
+				ops = jsonPatch(ops, p, fv, tv)
+			}
+		}
+		return ops
+
+	case []interface{}:
+		t, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		i := 0
+		for ; i < len(f) && i < len(t); i++ {
+			ops = jsonPatch(ops, fmt.Sprintf("%s/%d", path, i), f[i], t[i])
+		}
+		// Remove from the end, so indexes stay valid
+		for j := len(f) - 1; j >= i; j-- {
+			ops = append(ops, op("remove", fmt.Sprintf("%s/%d", path, j), nil))
+		}
+		for ; i < len(t); i++ {
+			ops = append(ops, op("add", fmt.Sprintf("%s/%d", path, i), t[i]))
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(normalizeNumbers(from), normalizeNumbers(to)) {
+		ops = append(ops, op("replace", path, to))
+	}
+	return ops
+}
+
+// shown returns whether objDiff matches c.Filter (and c.Quiet).
+func (c DiffCmd) shown(objDiff ObjectDiff) bool {
+	if c.Quiet && objDiff.Status == DiffStatusUnchanged {
+		return false
+	}
+	switch c.Filter {
+	case DiffFilterCreated, DiffFilterChanged:
+		if objDiff.Status != DiffStatus(c.Filter) && objDiff.Status != DiffStatusError {
+			return false
+		}
+	}
+	return true
+}
+
+// outputFile is an entry in the c.OutputDir index.
+type outputFile struct {
+	status DiffStatus
+	desc   string
+	name   string
+}
+
+// writeObject prints report to out or, with c.OutputDir, to a file
+// of its own there, which is appended to index.
+func (c DiffCmd) writeObject(out io.Writer, report objectReport, index *[]outputFile) error {
+	if c.OutputDir == "" {
+		return c.printObject(out, report)
+	}
+	objDiff := report.ObjectDiff
+	if objDiff.Status == DiffStatusUnchanged || !c.shown(objDiff) {
+		return nil
+	}
+
+	kind := objDiff.GroupVersionKind.Kind
+	if group := objDiff.GroupVersionKind.Group; group != "" {
+		// Kinds of the same name can be in several groups
+		kind += "." + group
+	}
+	name := fmt.Sprintf("%s_%s.diff", kind, objDiff.Name)
+	if report.namespace != "" {
+		name = report.namespace + "_" + name
+	}
+	f, err := os.Create(filepath.Join(c.OutputDir, name))
+	if err != nil {
+		return err
+	}
+	if err := c.printObject(f, report); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	*index = append(*index, outputFile{status: objDiff.Status, desc: report.desc, name: name})
+	return nil
+}
+
+// writeIndex writes the c.OutputDir index.txt, one "<status> <desc>
+// <file>" line per diff written.
+func (c DiffCmd) writeIndex(index []outputFile) error {
+	var buf bytes.Buffer
+	for _, e := range index {
+		fmt.Fprintf(&buf, "%s %s %s\n", e.status, e.desc, e.name)
+	}
+	return ioutil.WriteFile(filepath.Join(c.OutputDir, "index.txt"), buf.Bytes(), 0644)
+}
+
+// printObject writes the report for a single object, if it matches
+// c.Filter (and c.Quiet).
+func (c DiffCmd) printObject(out io.Writer, report objectReport) error {
+	objDiff, desc := report.ObjectDiff, report.desc
+	if !c.shown(objDiff) {
+		return nil
+	}
+	if c.Format == DiffFormatNames {
+		printName(out, objDiff, desc)
+		return nil
+	}
+
+	m := c.markup(out)
+	if c.Format == DiffFormatHTML {
+		fmt.Fprintln(out, `<pre class="diff">`)
+		defer fmt.Fprintln(out, "</pre>")
+	}
+
+	desc = m.text(desc)
+	if !c.Stat {
+		fmt.Fprintln(out, "---")
+		if c.Against == AgainstPreviousAnnotation {
+			fmt.Fprintf(out, "- previous %s\n+ live %s\n", desc, desc)
+		} else if objDiff.Hash != "" {
+			fmt.Fprintf(out, "- live %s\n+ config %s @%s\n", desc, desc, objDiff.Hash)
+		} else {
+			fmt.Fprintf(out, "- live %s\n+ config %s\n", desc, desc)
+		}
+	}
+	switch objDiff.Status {
+	case DiffStatusError:
+		fmt.Fprintf(out, "WARNING: %s\n", m.text(objDiff.Error.Error()))
+	case DiffStatusOrphaned:
+		if c.DeletionPreview {
+			fmt.Fprintf(out, "%s would be deleted\n", desc)
+		} else if c.manifests != nil {
+			fmt.Fprintf(out, "%s isn't in config\n", desc)
+		} else {
+			fmt.Fprintf(out, "%s isn't in config, and would be garbage collected\n", desc)
+		}
+		if !c.Stat {
+			if err := c.writeDiff(out, report.diff, m); err != nil {
+				return err
+			}
+		}
+	case DiffStatusCreated:
+		fmt.Fprintf(out, "%s doesn't exist on server\n", desc)
+		if report.diff != nil && !c.Stat {
+			if err := c.writeDiff(out, report.diff, m); err != nil {
+				return err
+			}
+		}
+	case DiffStatusUnchanged:
+		if c.DeletionPreview {
+			fmt.Fprintf(out, "%s doesn't exist on server, nothing to delete\n", desc)
+			break
+		}
+		if report.noPrevious {
+			fmt.Fprintf(out, "%s has no previous version\n", desc)
+			break
+		}
+		fmt.Fprintf(out, "%s unchanged\n", desc)
+	case DiffStatusChanged:
+		if tl := report.tooLarge; tl != nil {
+			fmt.Fprintf(out, "%s changed: %s: %d -> %d bytes\n", desc, tl, tl.liveSize, tl.configSize)
+			break
+		}
+		if len(objDiff.Conflicts) > 0 {
+			fmt.Fprintf(out, "%s has conflicts:\n", desc)
+			for _, conflict := range objDiff.Conflicts {
+				if conflict.Field != "" {
+					fmt.Fprintf(out, "  %s: %s\n", m.text(conflict.Field), m.text(conflict.Message))
+				} else {
+					fmt.Fprintf(out, "  %s\n", m.text(conflict.Message))
+				}
+			}
+			break
+		}
+		if c.Stat {
+			fmt.Fprintf(out, "%s changed, +%d -%d\n", desc, objDiff.Added, objDiff.Removed)
+			break
+		}
+		if err := c.writeDiff(out, report.diff, m); err != nil {
+			return err
+		}
+		if report.patchRedacted {
+			fmt.Fprintln(out, "patch: <omitted>")
+		} else if report.patch != nil {
+			fmt.Fprintf(out, "patch (%s):\n%s\n", patchTypeName(report.patchType), m.text(string(report.patch)))
+		}
+	}
+	if objDiff.NoSchema && objDiff.Status == DiffStatusChanged {
+		fmt.Fprintf(out, "NOTE: %s diff computed without schema; server result may differ\n", desc)
+	}
+	for _, field := range objDiff.Immutable {
+		fmt.Fprintf(out, "WARNING: %s is immutable, updating %s will fail\n", field, desc)
+	}
+	for _, err := range objDiff.Invalid {
+		fmt.Fprintf(out, "WARNING: %s is invalid: %s\n", desc, m.text(err.Error()))
+	}
+	return c.printDependents(out, report, m)
+}
+
+// printDependents writes the current state of each of
+// report.dependents, see DiffCmd.IncludeDependents.
+func (c DiffCmd) printDependents(out io.Writer, report objectReport, m *diffMarkup) error {
+	// Shown whole, through the same normalization as diffs
+	dc := c
+	dc.DiffStrategy = "all"
+	dc.IncludeStatus = true
+	dc.Context = -1
+	for _, dep := range report.dependents {
+		fmt.Fprintf(out, "%s is owned by %s\n", m.text(c.describe(dep)), m.text(report.desc))
+		if c.Stat {
+			continue
+		}
+		diff, err := dc.diffObjects(dep, dep, nil)
+		if err != nil {
+			fmt.Fprintf(out, "WARNING: %s\n", m.text(err.Error()))
+			continue
+		}
+		if err := dc.writeDiff(out, diff, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchTypeName returns the `kubectl patch --type` for pt.
+func patchTypeName(pt types.PatchType) string {
+	switch pt {
+	case types.StrategicMergePatchType:
+		return "strategic"
+	case types.MergePatchType:
+		return "merge"
+	case types.JSONPatchType:
+		return "json"
+	}
+	return string(pt)
+}
+
+// printName writes the DiffFormatNames line for objDiff.
+func printName(out io.Writer, objDiff ObjectDiff, desc string) {
+	name := objDiff.GroupVersionKind.GroupVersion().String() + "/" + desc
+	switch objDiff.Status {
+	case DiffStatusChanged:
+		fmt.Fprintf(out, "~ %s\n", name)
+	case DiffStatusCreated:
+		fmt.Fprintf(out, "+ %s\n", name)
+	case DiffStatusUnchanged:
+		fmt.Fprintf(out, "= %s\n", name)
+	case DiffStatusOrphaned:
+		fmt.Fprintf(out, "- %s\n", name)
+	case DiffStatusError:
+		fmt.Fprintf(out, "! %s: %v\n", name, objDiff.Error)
+	}
+}
+
+// markup returns the highlighting to use for output to out.
+func (c DiffCmd) markup(out io.Writer) *diffMarkup {
+	if c.Format == DiffFormatHTML {
+		return htmlMarkup
+	}
+	if c.useColor(out) {
+		return ansiMarkup
+	}
+	return nil
+}
+
+// fetchLive fetches the live version of each object, issuing up to
+// c.Concurrency requests in parallel.  The results, errors and time
+// taken by each fetch are in the same order as objs.  Unless
+// c.ContinueOnError, fetching stops at the first error.
+func (c DiffCmd) fetchLive(ctx context.Context, source LiveSource, objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, []error, []time.Duration) {
+	workers := c.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*unstructured.Unstructured, len(objs))
+	errs := make([]error, len(objs))
+	times := make([]time.Duration, len(objs))
+
+	indexes := make(chan int)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var wg sync.WaitGroup
+	var progressMu sync.Mutex
+	done := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				start := time.Now()
+				results[i], errs[i] = c.fetchOne(ctx, source, objs[i])
+				times[i] = time.Since(start)
+				if errs[i] != nil && !c.ContinueOnError {
+					stopOnce.Do(func() { close(stop) })
+				}
+				if c.OnProgress != nil {
+					progressMu.Lock()
+					done++
+					c.OnProgress(done, len(objs))
+					progressMu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range objs {
+		select {
+		case indexes <- i:
+		case <-stop:
+			break feed
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results, errs, times
+}
+
+func (c DiffCmd) fetchOne(ctx context.Context, source LiveSource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	desc := c.describe(obj)
+	log.Debug("Fetching ", desc)
+
+	if obj.GetName() == "" && c.MatchBy == "" {
+		return nil, fmt.Errorf("Error fetching one of the %s: it does not have a name set", utils.ResourceNameFor(c.Mapper, obj))
+	}
+
+	backoff := wait.Backoff{Steps: 1}
+	if c.RetryPolicy != nil && c.RetryPolicy.Steps > 1 {
+		backoff = *c.RetryPolicy
+	}
+	var liveObj *unstructured.Unstructured
+	var err error
+	_ = wait.ExponentialBackoff(backoff, func() (bool, error) {
+		liveObj, err = getContext(ctx, source, obj)
+		if err != nil && err != ctx.Err() && isRetryable(err) {
+			log.Debugf("Transient error fetching %s: %v", desc, err)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			if kind := c.suggestKind(obj.GetKind()); kind != "" {
+				return nil, fmt.Errorf("Error fetching %s: %v, did you mean %s?", desc, err, kind)
+			}
+		}
+		return nil, fmt.Errorf("Error fetching %s: %v", desc, err)
+	}
+	if liveObj == nil {
+		log.Debugf("%s doesn't exist on the server", desc)
+	}
+	return liveObj, nil
+}
+
+// missingKinds returns the kinds of the objs that weren't found on
+// the server, and that c.Discovery doesn't serve, see StrictCRD.
+// Objects whose fetch failed are left to report their own error.
+func (c DiffCmd) missingKinds(objs, liveObjs []*unstructured.Unstructured, fetchErrs []error) ([]string, error) {
+	served := map[schema.GroupVersion]sets.String{}
+	missing := sets.NewString()
+	for i, obj := range objs {
+		if liveObjs[i] != nil || fetchErrs[i] != nil {
+			continue
+		}
+		gvk := obj.GroupVersionKind()
+		gv := gvk.GroupVersion()
+		kinds, ok := served[gv]
+		if !ok {
+			kinds = sets.NewString()
+			list, err := c.Discovery.ServerResourcesForGroupVersion(gv.String())
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+			if list != nil {
+				for _, r := range list.APIResources {
+					kinds.Insert(r.Kind)
+				}
+			}
+			served[gv] = kinds
+		}
+		if !kinds.Has(gvk.Kind) {
+			missing.Insert(fmt.Sprintf("%s (%s)", gvk.Kind, gv))
+		}
+	}
+	return missing.List(), nil
+}
+
+// suggestKind returns the kind known to c.Discovery that the unknown
+// kind was most likely meant to be: one spelled the same but for
+// case, whose resource has kind as a short or singular name (eg:
+// "deploy"), or failing that the closest within a couple of typos
+// (eg: "Deploymnet").  It returns "" if there's none.
+func (c DiffCmd) suggestKind(kind string) string {
+	if c.Discovery == nil {
+		return ""
+	}
+	lists, err := c.Discovery.ServerResources()
+	if err != nil {
+		// Partial results are still useful
+		log.Debugf("Error listing resources for kind suggestions: %v", err)
+	}
+	lower := strings.ToLower(kind)
+	best, bestDistance := "", 3
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			if strings.Contains(r.Name, "/") {
+				// Subresource
+				continue
+			}
+			if strings.EqualFold(r.Kind, kind) || r.Name == lower || r.SingularName == lower || stringListContains(r.ShortNames, lower) {
+				return r.Kind
+			}
+			if d := editDistance(lower, strings.ToLower(r.Kind)); d < bestDistance && d < len(kind)/2 {
+				best, bestDistance = r.Kind, d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur[j] = prev[j-1]
+			if a[i-1] != b[j-1] {
+				cur[j]++
+			}
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// getContext calls source.Get(obj), but returns ctx.Err() as soon as
+// ctx is done.  The vendored client-go doesn't support contexts, so
+// the request itself carries on in the background.
+func getContext(ctx context.Context, source LiveSource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		obj *unstructured.Unstructured
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		obj, err := source.Get(obj)
+		ch <- result{obj, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.obj, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// isRetryable returns true for errors that may go away by
+// themselves, from a busy or flaky server.
+func isRetryable(err error) bool {
+	return errors.IsTooManyRequests(err) ||
+		errors.IsServerTimeout(err) ||
+		errors.IsTimeout(err) ||
+		errors.IsInternalError(err) ||
+		errors.IsServiceUnavailable(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// describe returns a human-readable name for obj, of the form
+// Kind/namespace/name for namespaced objects and Kind/name for
+// cluster-scoped objects.
+func (c DiffCmd) describe(obj *unstructured.Unstructured) string {
+	if ns := c.effectiveNamespace(obj); ns != "" {
+		return fmt.Sprintf("%s/%s/%s", obj.GetKind(), ns, obj.GetName())
+	}
+	return fmt.Sprintf("%s/%s", obj.GetKind(), obj.GetName())
+}
+
+// effectiveNamespace returns the namespace obj is fetched from, with
+// DefaultNamespace applied, or "" if obj is cluster-scoped.
+func (c DiffCmd) effectiveNamespace(obj *unstructured.Unstructured) string {
+	if c.Mapper == nil {
+		// Offline
+		return obj.GetNamespace()
+	}
+	gvk := obj.GroupVersionKind()
+	mapping, err := c.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		// Unknown scope, go with whatever the object says
+		log.Debugf("RESTMapper failed for %s (%s)", gvk, err)
+		return obj.GetNamespace()
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return ""
+	}
+	if ns := obj.GetNamespace(); ns != "" {
+		return ns
+	}
+	return c.DefaultNamespace
+}
+
+// DiffOptions are the settings for DiffManifests, as for the DiffCmd
+// fields of the same names.
+type DiffOptions struct {
+	DefaultNamespace string
+	DiffStrategy     string
+	StrategyByKind   map[string]string
+	OmitSecrets      bool
+	IgnorePaths      []string
+	IgnoreWhitespace bool
+	SuppressLines    []*regexp.Regexp
+	MaxValueLen      int
+
+	LabelSelector        string
+	Namespaces           []string
+	IncludeClusterScoped bool
+
+	Layout        string
+	Format        string
+	Color         string
+	Width         int
+	Context       int
+	Granularity   string
+	Serialization string
+	Quiet         bool
+	Filter        string
+	Stat          bool
+	Summary       bool
+	GroupByKind   bool
+	ErrorOnDiff   *bool
+}
+
+// DiffManifests diffs two sets of objects with no server, eg: the
+// output of some jsonnet before and after a library upgrade.  b is
+// diffed as config against a, with objects paired by group, kind,
+// namespace and name.  Objects only in a are shown as deleted, and
+// those only in b in full.  Lists in either are flattened.
+func DiffManifests(a, b []*unstructured.Unstructured, opts DiffOptions, out io.Writer) error {
+	c := DiffCmd{
+		DefaultNamespace:     opts.DefaultNamespace,
+		DiffStrategy:         opts.DiffStrategy,
+		StrategyByKind:       opts.StrategyByKind,
+		OmitSecrets:          opts.OmitSecrets,
+		IgnorePaths:          opts.IgnorePaths,
+		IgnoreWhitespace:     opts.IgnoreWhitespace,
+		SuppressLines:        opts.SuppressLines,
+		MaxValueLen:          opts.MaxValueLen,
+		LabelSelector:        opts.LabelSelector,
+		Namespaces:           opts.Namespaces,
+		IncludeClusterScoped: opts.IncludeClusterScoped,
+		Layout:               opts.Layout,
+		Format:               opts.Format,
+		Color:                opts.Color,
+		Width:                opts.Width,
+		Context:              opts.Context,
+		Granularity:          opts.Granularity,
+		Serialization:        opts.Serialization,
+		Quiet:                opts.Quiet,
+		Filter:               opts.Filter,
+		Stat:                 opts.Stat,
+		Summary:              opts.Summary,
+		GroupByKind:          opts.GroupByKind,
+		ErrorOnDiff:          opts.ErrorOnDiff,
+		ShowCreateBody:       true,
+	}
+	a, _, err := c.flattenLists(a)
+	if err != nil {
+		return err
+	}
+	c.manifests = NewObjectLiveSource(a, c.DefaultNamespace)
+	c.LiveSource = c.manifests
+	return c.Run(b, out)
+}
+
+// DiffObjects computes the line diff between the live and config
+// objects, using the given diff strategy.  schema may be nil.
+func DiffObjects(live, config *unstructured.Unstructured, strategy string, schema openapi.Resources) ([]diffmatchpatch.Diff, error) {
+	c := DiffCmd{DiffStrategy: strategy}
+	return c.diffObjects(live, config, schema)
+}
+
+// diffObjects is DiffObjects for c.  If live is nil, config is
+// prepared as usual and returned as a single insertion.  Likewise if
+// config is nil, live is returned as a single deletion.
+func (c DiffCmd) diffObjects(live, config *unstructured.Unstructured, schema openapi.Resources) ([]diffmatchpatch.Diff, error) {
+	diff, _, err := c.diffMerged(live, config, schema)
+	return diff, err
+}
+
+// diffMerged is diffObjects, also returning the object config was
+// merged into by the DiffStrategyThreeWay or DiffStrategyServer
+// strategy, or nil for other strategies.
+func (c DiffCmd) diffMerged(live, config *unstructured.Unstructured, schema openapi.Resources) ([]diffmatchpatch.Diff, *unstructured.Unstructured, error) {
+	created, deleted := live == nil, config == nil
+	if created {
+		live = &unstructured.Unstructured{Object: map[string]interface{}{}}
+	}
+	if deleted {
+		// Just enough for kind-specific handling, eg: OmitSecrets
+		config = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		config.SetGroupVersionKind(live.GroupVersionKind())
+	}
+
+	var err error
+	switch {
+	case created, deleted:
+	case c.DiffStrategy == DiffStrategyThreeWay:
+		config, err = patch(live, config, kindSchema(schema, config))
+	case c.DiffStrategy == DiffStrategyServer:
+		config, err = c.serverDryRun(live, config, schema)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var merged *unstructured.Unstructured
+	if !created && !deleted && (c.DiffStrategy == DiffStrategyThreeWay || c.DiffStrategy == DiffStrategyServer) {
+		merged = config
+	}
+
+	// NB: normalizeNumbers also ensures we never modify the
+	// caller's objects below
+	liveObject := normalizeNumbers(live.Object).(map[string]interface{})
+	configObject := normalizeNumbers(config.Object).(map[string]interface{})
+	var owners map[string]string
+	if c.ShowManagers {
+		owners = fieldOwners(liveObject)
+	}
+	managed := c.ManagedAnnotations
+	if managed == nil {
+		managed = DefaultManagedAnnotations
+	}
+	liveObject = stripManagedAnnotations(liveObject, managed)
+	configObject = stripManagedAnnotations(configObject, managed)
+	if !c.KeepManagedFields {
+		path := []string{"metadata", "managedFields"}
+		liveObject = prunePath(liveObject, path).(map[string]interface{})
+		configObject = prunePath(configObject, path).(map[string]interface{})
+	}
+	includeStatus := c.IncludeStatus
+	if len(c.Sections) > 0 {
+		liveObject = selectSections(liveObject, c.Sections)
+		configObject = selectSections(configObject, c.Sections)
+		for _, section := range c.Sections {
+			includeStatus = includeStatus || section == "status"
+		}
+	}
+	if !includeStatus {
+		liveObject = prunePath(liveObject, []string{"status"}).(map[string]interface{})
+		configObject = prunePath(configObject, []string{"status"}).(map[string]interface{})
+	}
+	if !c.KeepServerMetadata {
+		for _, field := range serverMetadataFields {
+			path := []string{"metadata", field}
+			liveObject = prunePath(liveObject, path).(map[string]interface{})
+			configObject = prunePath(configObject, path).(map[string]interface{})
+		}
+	}
+	for _, p := range c.IgnorePaths {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		liveObject = prunePath(liveObject, path).(map[string]interface{})
+		configObject = prunePath(configObject, path).(map[string]interface{})
+	}
+	if c.IgnoreWhitespace {
+		liveObject = normalizeWhitespace(liveObject).(map[string]interface{})
+		configObject = normalizeWhitespace(configObject).(map[string]interface{})
+	}
+	if c.IgnoreServerDefaults && schema != nil {
+		if s := schema.LookupResource(config.GroupVersionKind()); s != nil {
+			liveObject = removeDefaults(configObject, liveObject, s).(map[string]interface{})
+		}
+	}
+	if c.DiffStrategy == "subset" && !deleted {
+		var s proto.Schema
+		if schema != nil {
+			s = schema.LookupResource(config.GroupVersionKind())
+		}
+		liveObject = orderListElements(configObject, liveObject, s).(map[string]interface{})
+		subset := removeMapFields(configObject, liveObject, s)
+		if c.ShowExtraLiveFields {
+			subset = restoreFields(subset, liveObject).(map[string]interface{})
+		}
+		liveObject = subset
+	}
+	if c.OmitSecrets && config.GetKind() == "Secret" {
+		liveObject, configObject = redactSecret(liveObject, configObject, !c.RedactPublicCerts, c.SecretRedactMode == SecretRedactFull)
+	} else {
+		paths, err := c.sensitivePaths(live, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.OmitSecrets && (hasSensitiveKey(liveObject) || hasSensitiveKey(configObject)) {
+			// Redacts any last-applied annotations too
+			liveObject, configObject = redactObject(liveObject, configObject, paths)
+			redactedLive, redactedConfig := redactSensitiveKeys(liveObject, configObject)
+			liveObject, configObject = redactedLive.(map[string]interface{}), redactedConfig.(map[string]interface{})
+		} else if paths != nil {
+			liveObject, configObject = redactObject(liveObject, configObject, paths)
+		}
+	}
+	if gk := config.GroupVersionKind().GroupKind(); gk.Group == "" && gk.Kind == "ConfigMap" && (liveObject["binaryData"] != nil || configObject["binaryData"] != nil) {
+		if c.OmitSecrets {
+			liveObject, configObject = redactObject(liveObject, configObject, [][]string{{"binaryData"}})
+		} else {
+			liveObject, configObject = summarizeBinaryData(liveObject, configObject)
+		}
+	}
+	if c.MaxValueLen > 0 {
+		truncatedLive, truncatedConfig := truncateValues(liveObject, configObject, c.MaxValueLen)
+		liveObject, configObject = truncatedLive.(map[string]interface{}), truncatedConfig.(map[string]interface{})
+	}
+	if c.PreProcess != nil {
+		for _, obj := range []map[string]interface{}{liveObject, configObject} {
+			if err := c.PreProcess(&unstructured.Unstructured{Object: obj}); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	liveText, err := c.marshal(liveObject)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deleted {
+		return []diffmatchpatch.Diff{{Type: diffmatchpatch.DiffDelete, Text: string(liveText)}}, merged, nil
+	}
+	if c.EqualityFunc != nil && !created && c.EqualityFunc(&unstructured.Unstructured{Object: liveObject}, &unstructured.Unstructured{Object: configObject}) {
+		return []diffmatchpatch.Diff{{Type: diffmatchpatch.DiffEqual, Text: string(liveText)}}, merged, nil
+	}
+	configText, err := c.marshal(configObject)
+	if err != nil {
+		return nil, nil, err
+	}
+	if created {
+		return []diffmatchpatch.Diff{{Type: diffmatchpatch.DiffInsert, Text: string(configText)}}, merged, nil
+	}
+	if c.MaxObjectBytes > 0 && (len(liveText) > c.MaxObjectBytes || len(configText) > c.MaxObjectBytes) {
+		if bytes.Equal(liveText, configText) {
+			return []diffmatchpatch.Diff{{Type: diffmatchpatch.DiffEqual, Text: string(liveText)}}, merged, nil
+		}
+		return nil, merged, &objectTooLargeError{liveSize: len(liveText), configSize: len(configText)}
+	}
+
+	dmp := diffmatchpatch.New()
+	switch {
+	case c.DiffTimeout < 0:
+		dmp.DiffTimeout = 0
+	case c.DiffTimeout > 0:
+		dmp.DiffTimeout = c.DiffTimeout
+	}
+	liveTextLines, configTextLines, lines := dmp.DiffLinesToChars(string(liveText), string(configText))
+
+	diff := dmp.DiffMain(
+		string(liveTextLines),
+		string(configTextLines),
+		false)
+	diff = dmp.DiffCharsToLines(diff, lines)
+
+	// Lines are matched to their fields by position, so annotated
+	// before any are suppressed
+	if len(owners) > 0 && c.Serialization != "yaml" {
+		diff = annotateManagers(diff, string(liveText), string(configText), owners)
+	}
+	if len(c.SuppressLines) > 0 {
+		diff = suppressLines(diff, c.SuppressLines)
+	}
+	return diff, merged, nil
+}
+
+// selectSections returns a copy of obj with only the given top-level
+// fields, and its apiVersion and kind.
+func selectSections(obj map[string]interface{}, sections []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(sections)+2)
+	for _, field := range append([]string{"apiVersion", "kind"}, sections...) {
+		if v, ok := obj[field]; ok {
+			result[field] = v
+		}
+	}
+	return result
+}
+
+// Metadata fields set by the server, rather than config
+var serverMetadataFields = []string{
+	"creationTimestamp",
+	"generation",
+	"resourceVersion",
+	"selfLink",
+	"uid",
+}
+
+// Well-known fields that can't be changed once an object is
+// created, by GroupKind
+var immutableFields = map[schema.GroupKind][]string{
+	{Group: "apps", Kind: "Deployment"}:                              {"spec.selector"},
+	{Group: "apps", Kind: "ReplicaSet"}:                              {"spec.selector"},
+	{Group: "apps", Kind: "DaemonSet"}:                               {"spec.selector"},
+	{Group: "apps", Kind: "StatefulSet"}:                             {"spec.selector", "spec.serviceName", "spec.podManagementPolicy"},
+	{Group: "batch", Kind: "Job"}:                                    {"spec.selector"},
+	{Group: "", Kind: "Service"}:                                     {"spec.clusterIP"},
+	{Group: "", Kind: "PersistentVolumeClaim"}:                       {"spec.accessModes", "spec.storageClassName", "spec.volumeName"},
+	{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"}:        {"roleRef"},
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}: {"roleRef"},
+}
+
+// immutableChanges returns the immutable fields (see
+// immutableFields) that config sets to a different value from live.
+// ConfigMaps and Secrets marked immutable can't change their data.
+func immutableChanges(live, config *unstructured.Unstructured) []string {
+	gk := config.GroupVersionKind().GroupKind()
+	fields := immutableFields[gk]
+	if gk.Group == "" && (gk.Kind == "ConfigMap" || gk.Kind == "Secret") {
+		if immutable, _, _ := unstructured.NestedBool(live.Object, "immutable"); immutable {
+			fields = []string{"data", "binaryData"}
+		}
+	}
+
+	var changed []string
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		configVal, ok, _ := unstructured.NestedFieldNoCopy(config.Object, path...)
+		if !ok {
+			continue
+		}
+		liveVal, _, _ := unstructured.NestedFieldNoCopy(live.Object, path...)
+		if !reflect.DeepEqual(normalizeNumbers(liveVal), normalizeNumbers(configVal)) {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// DefaultManagedAnnotations are the annotations removed before
+// diffing when DiffCmd.ManagedAnnotations is nil.  AnnotationOrigObject
+// only records (old or new) config, so is just noise.
+var DefaultManagedAnnotations = []string{AnnotationOrigObject}
+
+// stripManagedAnnotations returns obj without the given annotations,
+// or metadata.annotations at all if those were the only ones.
+// Otherwise an object that had no annotations would differ from its
+// merged version by an empty map.
+func stripManagedAnnotations(obj map[string]interface{}, annotations []string) map[string]interface{} {
+	if len(annotations) == 0 {
+		return obj
+	}
+	for _, anno := range annotations {
+		obj = prunePath(obj, []string{"metadata", "annotations", anno}).(map[string]interface{})
+	}
+	if annos, ok, _ := unstructured.NestedMap(obj, "metadata", "annotations"); ok && len(annos) == 0 {
+		obj = prunePath(obj, []string{"metadata", "annotations"}).(map[string]interface{})
+	}
+	return obj
+}
+
+// kindSchema returns the schema for obj's kind, if schema has a
+// usable one.
+func kindSchema(schema openapi.Resources, obj *unstructured.Unstructured) proto.Schema {
+	if schema == nil {
+		return nil
+	}
+	s := schema.LookupResource(obj.GroupVersionKind())
+	if !isValidKindSchema(s) {
+		log.Debugf("Ignoring invalid schema for %s", obj.GroupVersionKind())
+		return nil
+	}
+	return s
+}
+
+// serverDryRun returns the object the server would store if live
+// were updated to config, without persisting anything.  It sends the
+// same PATCH as update would, with only DryRun set in its options.
+func (c DiffCmd) serverDryRun(live, config *unstructured.Unstructured, schema openapi.Resources) (*unstructured.Unstructured, error) {
+	if c.Client == nil {
+		return nil, fmt.Errorf("The %s diff strategy requires a server", DiffStrategyServer)
+	}
+	pt, data, err := createPatch(live, config, kindSchema(schema, config))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := utils.ClientForResource(c.Client, c.Mapper, config, c.DefaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Patch(config.GetName(), pt, data, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})
+}
+
+// conflictFields returns the fields named by a conflict error from
+// the server, or just its message if it names none (eg: for a stale
+// resourceVersion).
+func conflictFields(err error) []DiffConflict {
+	var conflicts []DiffConflict
+	if status, ok := err.(errors.APIStatus); ok && status.Status().Details != nil {
+		for _, cause := range status.Status().Details.Causes {
+			conflicts = append(conflicts, DiffConflict{Field: cause.Field, Message: cause.Message})
+		}
+	}
+	if len(conflicts) == 0 {
+		conflicts = append(conflicts, DiffConflict{Message: err.Error()})
+	}
+	return conflicts
+}
+
+// diffStat returns the number of lines inserted and deleted by
+// diffs.
+func diffStat(diffs []diffmatchpatch.Diff) (added, removed int) {
+	for _, diff := range diffs {
+		lines := strings.Count(diff.Text, "\n")
+		if diff.Text != "" && !strings.HasSuffix(diff.Text, "\n") {
+			// Last line of the text
+			lines++
+		}
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			added += lines
+		case diffmatchpatch.DiffDelete:
+			removed += lines
+		}
+	}
+	return added, removed
+}
+
+// isEmptyDiff returns true if diffs contains no changes
+func isEmptyDiff(diffs []diffmatchpatch.Diff) bool {
+	for _, diff := range diffs {
+		if diff.Type != diffmatchpatch.DiffEqual {
+			return false
+		}
+	}
+	return true
+}
+
+// marshal renders obj as text to be diffed, in the configured
+// serialization.  Map keys are always sorted.
+func (c DiffCmd) marshal(obj map[string]interface{}) ([]byte, error) {
+	if c.Serialization == "yaml" {
+		buf, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf, []byte("\n")), nil
+	}
+	indent := c.Indent
+	if indent == "" {
+		indent = "  "
+	}
+	return marshalIndent(obj, indent)
+}
+
+// marshalIndent is like json.MarshalIndent, but without escaping
+// HTML characters (eg: in redaction placeholders).
+func marshalIndent(v interface{}, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Formats the supplied Diff as a unified-diff-like text and
+// optionally colorizes it.  If c.Context is not negative, unchanged
+// lines further than c.Context from a change are collapsed into
+// "@@ -l,s +l,s @@" hunk headers.
+func (c DiffCmd) formatDiff(diffs []diffmatchpatch.Diff, color bool) string {
+	var m *diffMarkup
+	if color {
+		m = ansiMarkup
+	}
+	var buff bytes.Buffer
+	_ = c.writeDiff(&buff, diffs, m)
+	return strings.TrimSuffix(buff.String(), "\n")
+}
+
+// writeDiff writes the same text as formatDiff (followed by a
+// newline) to out, as it is produced, highlighted with m (may be
+// nil).
+func (c DiffCmd) writeDiff(out io.Writer, diffs []diffmatchpatch.Diff, m *diffMarkup) error {
+	w := &diffWriter{w: out}
+	if c.HunkPaths && c.Serialization != "yaml" {
+		return c.writePathDiff(w, diffs, m)
+	}
+	if c.Context < 0 {
+		c.formatLines(w, diffs, m)
+		w.endLine()
+		return w.err
+	}
+
+	for _, hunk := range contextHunks(splitDiffLines(diffs), c.Context) {
+		w.WriteString(hunk.header() + "\n")
+		c.formatLines(w, linesToDiffs(hunk.lines), m)
+		w.endLine()
+	}
+	return w.err
+}
+
+// writePathDiff is writeDiff for c.HunkPaths.
+func (c DiffCmd) writePathDiff(w *diffWriter, diffs []diffmatchpatch.Diff, m *diffMarkup) error {
+	lines := splitDiffLines(diffs)
+	paths := diffLinePaths(lines)
+
+	if c.Context >= 0 {
+		for _, hunk := range contextHunks(lines, c.Context) {
+			header := hunk.header()
+			for i, line := range hunk.lines {
+				if line.Type != diffmatchpatch.DiffEqual {
+					header += " " + m.text(paths[hunk.first+i])
+					break
+				}
+			}
+			w.WriteString(header + "\n")
+			c.formatLines(w, linesToDiffs(hunk.lines), m)
+			w.endLine()
+		}
+		return w.err
+	}
+
+	// Split before each run of changed lines
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && (lines[i].Type == diffmatchpatch.DiffEqual || (i > 0 && lines[i-1].Type != diffmatchpatch.DiffEqual)) {
+			continue
+		}
+		if i > start {
+			if lines[start].Type != diffmatchpatch.DiffEqual {
+				w.WriteString(fmt.Sprintf("@@ %s @@\n", m.text(paths[start])))
+			}
+			c.formatLines(w, linesToDiffs(lines[start:i]), m)
+			w.endLine()
+		}
+		start = i
+	}
+	return w.err
+}
+
+// diffLinePaths returns the jsonLinePaths path of each line: in live
+// for unchanged and deleted lines, or in config for inserted lines.
+func diffLinePaths(lines []diffLine) []string {
+	var live, config []string
+	for _, line := range lines {
+		if line.Type != diffmatchpatch.DiffInsert {
+			live = append(live, line.Text)
+		}
+		if line.Type != diffmatchpatch.DiffDelete {
+			config = append(config, line.Text)
+		}
+	}
+	livePaths := jsonLinePaths(strings.Join(live, "\n"))
+	configPaths := jsonLinePaths(strings.Join(config, "\n"))
+
+	paths := make([]string, len(lines))
+	liveLine, configLine := 0, 0
+	for i, line := range lines {
+		switch line.Type {
+		case diffmatchpatch.DiffEqual:
+			paths[i] = livePaths[liveLine]
+			liveLine++
+			configLine++
+		case diffmatchpatch.DiffDelete:
+			paths[i] = livePaths[liveLine]
+			liveLine++
+		case diffmatchpatch.DiffInsert:
+			paths[i] = configPaths[configLine]
+			configLine++
+		}
+	}
+	return paths
+}
+
+// diffWriter writes diff text to an io.Writer, remembering the
+// first error and the last byte written.
+type diffWriter struct {
+	w    io.Writer
+	last byte
+	err  error
+}
+
+func (w *diffWriter) WriteString(s string) {
+	if w.err != nil || s == "" {
+		return
+	}
+	_, w.err = io.WriteString(w.w, s)
+	w.last = s[len(s)-1]
+}
+
+// endLine terminates the current line, unless it already has been.
+func (w *diffWriter) endLine() {
+	if w.last != '\n' {
+		w.WriteString("\n")
+	}
+}
+
+// diffMarkup describes how to highlight diff text.  A nil
+// *diffMarkup means plain text.
+type diffMarkup struct {
+	// Around inserted and deleted text
+	insert, delete, end string
+	// Around the changed spans of changed lines
+	changed, changedEnd string
+	// Escapes text, if needed
+	escape func(string) string
+}
+
+var ansiMarkup = &diffMarkup{
+	insert:     "\x1b[32m",
+	delete:     "\x1b[31m",
+	end:        "\x1b[0m",
+	changed:    "\x1b[7m",
+	changedEnd: "\x1b[27m",
+}
+
+var htmlMarkup = &diffMarkup{
+	insert:     `<span class="diff-add">`,
+	delete:     `<span class="diff-del">`,
+	end:        "</span>",
+	changed:    "<mark>",
+	changedEnd: "</mark>",
+	escape:     htmlEscaper.Replace,
+}
+
+// Escapes element content.  Unlike html.EscapeString, this leaves
+// quotes alone, to keep JSON readable.
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// start returns the markup preceding text of type op.
+func (m *diffMarkup) start(op diffmatchpatch.Operation) string {
+	if m == nil {
+		return ""
+	}
+	switch op {
+	case diffmatchpatch.DiffInsert:
+		return m.insert
+	case diffmatchpatch.DiffDelete:
+		return m.delete
+	}
+	return ""
+}
+
+// stop returns the markup following text of type op.
+func (m *diffMarkup) stop(op diffmatchpatch.Operation) string {
+	if m == nil || op == diffmatchpatch.DiffEqual {
+		return ""
+	}
+	return m.end
+}
+
+// text returns s escaped as needed.
+func (m *diffMarkup) text(s string) string {
+	if m == nil || m.escape == nil {
+		return s
+	}
+	return m.escape(s)
+}
+
+// Formats the supplied Diff with infinite context, in the
+// configured layout.
+func (c DiffCmd) formatLines(w *diffWriter, diffs []diffmatchpatch.Diff, m *diffMarkup) {
+	if c.Layout == DiffLayoutSideBySide {
+		c.formatSideBySide(w, diffs, m)
+		return
+	}
+
+	for i := 0; i < len(diffs); i++ {
+		diff := diffs[i]
+
+		// A deletion immediately followed by an insertion is a
+		// set of changed lines
+		if c.Granularity == DiffGranularityWord && m != nil && diff.Type == diffmatchpatch.DiffDelete &&
+			i+1 < len(diffs) && diffs[i+1].Type == diffmatchpatch.DiffInsert {
+			writeWordDiff(w, diff.Text, diffs[i+1].Text, m)
+			i++
+			continue
+		}
+
+		var prefix string
+		switch diff.Type {
+		case diffmatchpatch.DiffInsert:
+			prefix = "+ "
+		case diffmatchpatch.DiffDelete:
+			prefix = "- "
+		case diffmatchpatch.DiffEqual:
+			prefix = "  "
+		}
+		w.WriteString(m.start(diff.Type))
+		w.WriteString(DiffLineStart.ReplaceAllString(m.text(diff.Text), "$1"+prefix+"$2"))
+		w.WriteString(m.stop(diff.Type))
+	}
+}
+
+// writeWordDiff writes the changed lines deleted -> inserted, with
+// the spans that actually changed within them highlighted (eg: in
+// inverse video).
+func writeWordDiff(w *diffWriter, deleted, inserted string, m *diffMarkup) {
+	dmp := diffmatchpatch.New()
+	words := dmp.DiffCleanupSemantic(dmp.DiffMain(deleted, inserted, false))
+
+	writeWordSide(w, words, diffmatchpatch.DiffDelete, "- ", m)
+	writeWordSide(w, words, diffmatchpatch.DiffInsert, "+ ", m)
+}
+
+// writeWordSide writes the op side of a word diff, starting each
+// line with prefix.
+func writeWordSide(w *diffWriter, words []diffmatchpatch.Diff, op diffmatchpatch.Operation, prefix string, m *diffMarkup) {
+	prefix = m.start(op) + prefix
+	bol := true
+	for _, word := range words {
+		if word.Type != op && word.Type != diffmatchpatch.DiffEqual {
+			continue
+		}
+		for i, piece := range strings.Split(word.Text, "\n") {
+			if i > 0 {
+				if bol {
+					// Empty line
+					w.WriteString(prefix)
+				}
+				w.WriteString(m.stop(op) + "\n")
+				bol = true
+			}
+			if piece == "" {
+				continue
+			}
+			if bol {
+				w.WriteString(prefix)
+				bol = false
+			}
+			if word.Type == op {
+				w.WriteString(m.changed + m.text(piece) + m.changedEnd)
+			} else {
+				w.WriteString(m.text(piece))
+			}
+		}
+	}
+	if !bol {
+		w.WriteString(m.stop(op))
+	}
+}
+
+// Formats the supplied Diff as two columns, live on the left and
+// config on the right.  Lines that don't fit in a column are
+// truncated.
+func (c DiffCmd) formatSideBySide(w *diffWriter, diffs []diffmatchpatch.Diff, m *diffMarkup) {
+	// Two columns of colWidth, separated by " | "
+	colWidth := (c.Width - 3) / 2
+	if colWidth < 10 {
+		colWidth = 10
+	}
+
+	writeRow := func(left, right string, leftOp, rightOp diffmatchpatch.Operation) {
+		writeColumn(w, left, colWidth, leftOp, m)
+		w.WriteString(" | ")
+		// No need to pad the last column
+		right = truncateColumn(right, colWidth)
+		writeColumn(w, right, len([]rune(right)), rightOp, m)
+		w.WriteString("\n")
+	}
+
+	var deleted, inserted []string
+	flush := func() {
+		for i := 0; i < len(deleted) || i < len(inserted); i++ {
+			left, right := "", ""
+			leftOp, rightOp := diffmatchpatch.DiffEqual, diffmatchpatch.DiffEqual
+			if i < len(deleted) {
+				left, leftOp = "- "+deleted[i], diffmatchpatch.DiffDelete
+			}
+			if i < len(inserted) {
+				right, rightOp = "+ "+inserted[i], diffmatchpatch.DiffInsert
+			}
+			writeRow(left, right, leftOp, rightOp)
+		}
+		deleted, inserted = nil, nil
+	}
+
+	for _, line := range splitDiffLines(diffs) {
+		text := line.Text
+		switch line.Type {
+		case diffmatchpatch.DiffDelete:
+			deleted = append(deleted, text)
+		case diffmatchpatch.DiffInsert:
+			inserted = append(inserted, text)
+		case diffmatchpatch.DiffEqual:
+			flush()
+			writeRow("  "+text, "  "+text, line.Type, line.Type)
+		}
+	}
+	flush()
+}
+
+// writeColumn writes text truncated or padded to width, highlighted
+// according to op.
+func writeColumn(w *diffWriter, text string, width int, op diffmatchpatch.Operation, m *diffMarkup) {
+	text = truncateColumn(text, width)
+	if pad := width - len([]rune(text)); pad > 0 {
+		text += strings.Repeat(" ", pad)
+	}
+	w.WriteString(m.start(op) + m.text(text) + m.stop(op))
+}
+
+func truncateColumn(text string, width int) string {
+	if r := []rune(text); len(r) > width {
+		return string(r[:width])
+	}
+	return text
+}
+
+// diffLine is a single line of a diff
+type diffLine struct {
+	Type diffmatchpatch.Operation
+	Text string
+}
+
+// splitDiffLines splits line-mode diffs (see DiffCharsToLines) into
+// individual lines, without the trailing newlines.
+func splitDiffLines(diffs []diffmatchpatch.Diff) []diffLine {
+	var lines []diffLine
+	for _, diff := range diffs {
+		for _, text := range strings.Split(strings.TrimSuffix(diff.Text, "\n"), "\n") {
+			lines = append(lines, diffLine{Type: diff.Type, Text: text})
+		}
+	}
+	return lines
+}
+
+// managerNote is the note annotateManagers appends to a line.
+var managerNote = regexp.MustCompile(`  \(manager: [^)]*\)$`)
+
+// suppressLines returns diffs without the changed lines matching any
+// of patterns, see DiffCmd.SuppressLines.  Lines are matched, and
+// any kept as unchanged are shown, without their managerNote.
+func suppressLines(diffs []diffmatchpatch.Diff, patterns []*regexp.Regexp) []diffmatchpatch.Diff {
+	matches := func(text string) bool {
+		for _, re := range patterns {
+			if re.MatchString(text) {
+				return true
+			}
+		}
+		return false
+	}
+	var lines []diffLine
+	for _, line := range splitDiffLines(diffs) {
+		if text := managerNote.ReplaceAllString(line.Text, ""); line.Type != diffmatchpatch.DiffEqual && matches(text) {
+			if line.Type == diffmatchpatch.DiffInsert {
+				continue
+			}
+			line.Type, line.Text = diffmatchpatch.DiffEqual, text
+		}
+		lines = append(lines, line)
+	}
+	return linesToDiffs(lines)
+}
+
+// linesToDiffs does the reverse of splitDiffLines.
+func linesToDiffs(lines []diffLine) []diffmatchpatch.Diff {
+	var diffs []diffmatchpatch.Diff
+	for _, line := range lines {
+		if n := len(diffs); n > 0 && diffs[n-1].Type == line.Type {
+			diffs[n-1].Text += line.Text + "\n"
+		} else {
+			diffs = append(diffs, diffmatchpatch.Diff{Type: line.Type, Text: line.Text + "\n"})
+		}
+	}
+	return diffs
+}
+
+// diffHunk is a contiguous range of diff lines, with (1-based)
+// positions in the live and config texts.
+type diffHunk struct {
+	liveStart, liveLines     int
+	configStart, configLines int
+	lines                    []diffLine
+	// Index of lines[0] in the whole diff
+	first int
+}
+
+func (h diffHunk) header() string {
+	liveStart, configStart := h.liveStart, h.configStart
+	// Like diff -U, an empty range starts at the line before
+	if h.liveLines == 0 {
+		liveStart--
+	}
+	if h.configLines == 0 {
+		configStart--
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", liveStart, h.liveLines, configStart, h.configLines)
+}
+
+// contextHunks groups lines into hunks containing every changed line
+// plus up to context unchanged lines either side.  Hunks closer than
+// 2*context lines are merged.
+func contextHunks(lines []diffLine, context int) []diffHunk {
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.Type == diffmatchpatch.DiffEqual {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var hunks []diffHunk
+	var cur *diffHunk
+	liveLine, configLine := 1, 1
+	for i, line := range lines {
+		if keep[i] {
+			if cur == nil {
+				cur = &diffHunk{liveStart: liveLine, configStart: configLine, first: i}
+			}
+			cur.lines = append(cur.lines, line)
+		} else if cur != nil {
+			hunks = append(hunks, *cur)
+			cur = nil
+		}
+
+		switch line.Type {
+		case diffmatchpatch.DiffEqual:
+			liveLine++
+			configLine++
+			if keep[i] {
+				cur.liveLines++
+				cur.configLines++
+			}
+		case diffmatchpatch.DiffDelete:
+			liveLine++
+			cur.liveLines++
+		case diffmatchpatch.DiffInsert:
+			configLine++
+			cur.configLines++
+		}
+	}
+	if cur != nil {
+		hunks = append(hunks, *cur)
+	}
+	return hunks
+}
+
+// terminalWidth returns the width of w if it is a terminal, or a
+// reasonable default otherwise.
+func terminalWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+		if width, _, err := terminal.GetSize(int(f.Fd())); err == nil && width > 0 {
+			return width
+		}
+	}
+	return defaultDiffWidth
+}
+
+// normalizeWhitespace returns v with the whitespace of every string
+// value normalized, see DiffCmd.IgnoreWhitespace.
+func normalizeWhitespace(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		lines := strings.Split(strings.TrimSpace(v), "\n")
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.Fields(line), " ")
+		}
+		return strings.Join(lines, "\n")
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = normalizeWhitespace(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeWhitespace(item)
+		}
+		return result
+	}
+	return v
+}
+
+// normalizeNumbers returns a deep copy of v with every number
+// converted to int64 if it is integral, or float64 otherwise.  This
+// ensures semantically equal numbers marshal identically, however
+// they were decoded (eg: 3, 3.0 or json.Number("3.0")).  Likewise
+// any other non-JSON value, such as an embedded runtime.RawExtension
+// or typed struct, is replaced by the result of decoding it from
+// JSON, so its keys are sorted and indented like the rest.
+func normalizeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int64:
+		return v
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = normalizeNumbers(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeNumbers(item)
+		}
+		return result
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return normalizeFloat(f)
+		}
+	case float64:
+		return normalizeFloat(v)
+	case float32:
+		// Convert via the shortest decimal representation, so that
+		// eg: float32(0.1) becomes 0.1 rather than 0.10000000149
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return normalizeFloat(f)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return normalizeNumbers(uint64(v))
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			break
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var decoded interface{}
+		if err := dec.Decode(&decoded); err == nil {
+			return normalizeNumbers(decoded)
+		}
+	}
+	return v
+}
+
+func normalizeFloat(f float64) interface{} {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f)
+	}
+	return f
+}
+
+// Matches the default value in OpenAPI field descriptions, eg:
+// `Defaults to "ClusterFirst".` or `Default to Always.`
+var documentedDefault = regexp.MustCompile(`\bDefaults? (?:to|is) "?([^\s"]+?)"?(?:[.,;]|\s|$)`)
+
+// removeDefaults returns a copy of live without the fields that are
+// absent from config and set to their documented default in s.
+func removeDefaults(config, live interface{}, s proto.Schema) interface{} {
+	switch s := deref(s).(type) {
+	case *proto.Kind:
+		liveMap, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		configMap, _ := config.(map[string]interface{})
+		result := make(map[string]interface{}, len(liveMap))
+		for k, v := range liveMap {
+			field := s.Fields[k]
+			if field == nil {
+				result[k] = v
+				continue
+			}
+			configVal, inConfig := configMap[k]
+			if !inConfig && isDocumentedDefault(field, v) {
+				continue
+			}
+			result[k] = removeDefaults(configVal, v, field)
+		}
+		return result
+	case *proto.Map:
+		liveMap, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		configMap, _ := config.(map[string]interface{})
+		result := make(map[string]interface{}, len(liveMap))
+		for k, v := range liveMap {
+			result[k] = removeDefaults(configMap[k], v, s.SubType)
+		}
+		return result
+	case *proto.Array:
+		liveList, ok := live.([]interface{})
+		if !ok {
+			return live
+		}
+		configList, _ := config.([]interface{})
+		matched := matchListElements(configList, liveList, s)
+		result := make([]interface{}, len(liveList))
+		for i, v := range liveList {
+			result[i] = removeDefaults(matched[i], v, s.SubType)
+		}
+		return result
+	}
+	return live
+}
+
+// isDocumentedDefault returns true if the primitive value v is the
+// default documented for field.
+func isDocumentedDefault(field proto.Schema, v interface{}) bool {
+	switch v.(type) {
+	case string, bool, int64, float64:
+	default:
+		return false
+	}
+	m := documentedDefault.FindStringSubmatch(field.GetDescription())
+	return m != nil && m[1] == fmt.Sprint(v)
+}
+
+// parseFieldPath splits a path like `a.b["c.d"]` into its fields.
+func parseFieldPath(path string) ([]string, error) {
+	var fields []string
+	rest := path
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			if len(rest) == 1 || rest[1] == '.' || rest[1] == '[' {
+				return nil, fmt.Errorf("Invalid path %q", path)
+			}
+			rest = rest[1:]
+		case strings.HasPrefix(rest, `["`) || strings.HasPrefix(rest, `['`):
+			end := strings.Index(rest[2:], rest[1:2]+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated %q in path %q", rest[:2], path)
+			}
+			fields = append(fields, rest[2:2+end])
+			rest = rest[2+end+2:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end == 0 {
+				return nil, fmt.Errorf("Invalid path %q", path)
+			}
+			if end < 0 {
+				end = len(rest)
+			}
+			fields = append(fields, rest[:end])
+			rest = rest[end:]
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Invalid empty path %q", path)
+	}
+	return fields, nil
+}
+
+// prunePath returns a copy of v with the field at path removed.
+// Lists along the way have the path removed from every element.
+func prunePath(v interface{}, path []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return v
+		}
+		result := copyMap(v)
+		if len(path) == 1 {
+			delete(result, path[0])
+		} else {
+			result[path[0]] = prunePath(child, path[1:])
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = prunePath(item, path)
+		}
+		return result
+	}
+	return v
+}
+
+// Fields of a Secret holding sensitive values
+var secretDataFields = []string{"data", "stringData"}
+
+// Annotations that may hold a complete copy of the object, including
+// any sensitive values
+var lastAppliedAnnotations = []string{
+	AnnotationOrigObject,
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// Keys holding sensitive values in typed Secrets, redacted wherever
+// they appear with OmitSecrets
+var sensitiveDataKeys = map[string]bool{
+	"tls.key":           true,
+	".dockerconfigjson": true,
+	".dockercfg":        true,
+}
+
+// Keys of a kubernetes.io/tls Secret holding certificates, which
+// aren't secret
+var publicCertKeys = []string{"tls.crt", "ca.crt"}
+
+// redactSecret returns copies of the live and config Secrets with
+// every sensitive value replaced by a placeholder.  Keys are kept, so
+// the diff still shows which keys were added, removed or changed.
+// With showCerts, the certificates of a TLS Secret are kept.  With
+// full, keys are hidden too, and only whether the data changed is
+// shown.
+func redactSecret(live, config map[string]interface{}, showCerts, full bool) (map[string]interface{}, map[string]interface{}) {
+	paths := make([][]string, len(secretDataFields))
+	for i, field := range secretDataFields {
+		paths[i] = []string{field}
+	}
+	redactedLive, redactedConfig := redactObject(live, config, paths)
+	if full {
+		for _, field := range secretDataFields {
+			// Compares the redacted values, which are marked if changed
+			redactKey(redactedLive, redactedConfig, field)
+		}
+		return redactedLive, redactedConfig
+	}
+
+	secretType, ok := config["type"]
+	if !ok {
+		secretType = live["type"]
+	}
+	if showCerts && secretType == "kubernetes.io/tls" {
+		for _, field := range secretDataFields {
+			restoreKeys(redactedLive, live, field, publicCertKeys)
+			restoreKeys(redactedConfig, config, field, publicCertKeys)
+		}
+	}
+	return redactedLive, redactedConfig
+}
+
+// restoreKeys puts the original values of keys in the map at
+// orig[field] back into the redacted copy made by redactField.
+func restoreKeys(redacted, orig map[string]interface{}, field string, keys []string) {
+	origData, _ := orig[field].(map[string]interface{})
+	redactedData, ok := redacted[field].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for _, k := range keys {
+		if v, ok := origData[k]; ok {
+			redactedData[k] = v
+		}
+	}
+}
+
+// hasSensitiveKey returns whether v has a map key in
+// sensitiveDataKeys, at any depth.
+func hasSensitiveKey(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if sensitiveDataKeys[k] || hasSensitiveKey(val) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if hasSensitiveKey(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactSensitiveKeys returns copies of live and config with the
+// value of every map key in sensitiveDataKeys, at any depth, replaced
+// by a placeholder.  Lists are compared by index.
+func redactSensitiveKeys(live, config interface{}) (interface{}, interface{}) {
+	liveMap, liveIsMap := live.(map[string]interface{})
+	configMap, configIsMap := config.(map[string]interface{})
+	if liveIsMap || configIsMap {
+		liveMap, configMap = copyMap(liveMap), copyMap(configMap)
+		keys := make(map[string]bool, len(liveMap)+len(configMap))
+		for k := range liveMap {
+			keys[k] = true
+		}
+		for k := range configMap {
+			keys[k] = true
+		}
+		for k := range keys {
+			if sensitiveDataKeys[k] {
+				redactKey(liveMap, configMap, k)
+				continue
+			}
+			liveVal, liveOk := liveMap[k]
+			configVal, configOk := configMap[k]
+			liveVal, configVal = redactSensitiveKeys(liveVal, configVal)
+			if liveOk {
+				liveMap[k] = liveVal
+			}
+			if configOk {
+				configMap[k] = configVal
+			}
+		}
+		if liveIsMap {
+			live = liveMap
+		}
+		if configIsMap {
+			config = configMap
+		}
+		return live, config
+	}
+
+	liveList, liveIsList := live.([]interface{})
+	configList, configIsList := config.([]interface{})
+	if liveIsList || configIsList {
+		redactedLive := make([]interface{}, len(liveList))
+		redactedConfig := make([]interface{}, len(configList))
+		for i := 0; i < len(liveList) || i < len(configList); i++ {
+			var liveVal, configVal interface{}
+			if i < len(liveList) {
+				liveVal = liveList[i]
+			}
+			if i < len(configList) {
+				configVal = configList[i]
+			}
+			liveVal, configVal = redactSensitiveKeys(liveVal, configVal)
+			if i < len(liveList) {
+				redactedLive[i] = liveVal
+			}
+			if i < len(configList) {
+				redactedConfig[i] = configVal
+			}
+		}
+		if liveIsList {
+			live = redactedLive
+		}
+		if configIsList {
+			config = redactedConfig
+		}
+	}
+	return live, config
+}
 
-// DiffCmd represents the diff subcommand
-type DiffCmd struct {
-	Client           dynamic.Interface
-	Mapper           meta.RESTMapper
-	DefaultNamespace string
-	OmitSecrets      bool
+// sensitivePaths returns the fields to redact from an object marked
+// with c.SensitiveAnnotation, or nil if it isn't marked.  The
+// annotation value is either "true", for the same fields as a
+// Secret, or a comma-separated list of field paths.
+func (c DiffCmd) sensitivePaths(live, config *unstructured.Unstructured) ([][]string, error) {
+	if c.SensitiveAnnotation == "" {
+		return nil, nil
+	}
+	value, ok := config.GetAnnotations()[c.SensitiveAnnotation]
+	if !ok {
+		value, ok = live.GetAnnotations()[c.SensitiveAnnotation]
+	}
+	if !ok || value == "false" {
+		return nil, nil
+	}
 
-	DiffStrategy string
+	if value == "true" {
+		value = strings.Join(secretDataFields, ",")
+	}
+	var paths [][]string
+	for _, p := range strings.Split(value, ",") {
+		path, err := parseFieldPath(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s annotation: %v", c.SensitiveAnnotation, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
 }
 
-func (c DiffCmd) Run(apiObjects []*unstructured.Unstructured, out io.Writer) error {
-	sort.Sort(utils.AlphabeticalOrder(apiObjects))
+// redactObject returns copies of the live and config objects with
+// the values at paths, and any last-applied annotations, replaced by
+// a placeholder.  Paths do not traverse lists.
+func redactObject(live, config map[string]interface{}, paths [][]string) (map[string]interface{}, map[string]interface{}) {
+	live, config = copyMap(live), copyMap(config)
 
-	dmp := diffmatchpatch.New()
-	diffFound := false
-	for _, obj := range apiObjects {
-		desc := fmt.Sprintf("%s %s", utils.ResourceNameFor(c.Mapper, obj), utils.FqName(obj))
-		log.Debug("Fetching ", desc)
+	for _, path := range paths {
+		redactPath(live, config, path)
+	}
 
-		client, err := utils.ClientForResource(c.Client, c.Mapper, obj, c.DefaultNamespace)
-		if err != nil {
-			return err
-		}
+	liveMeta, _ := live["metadata"].(map[string]interface{})
+	configMeta, _ := config["metadata"].(map[string]interface{})
+	liveMeta, configMeta = copyMap(liveMeta), copyMap(configMeta)
+	if liveMeta != nil {
+		live["metadata"] = liveMeta
+	}
+	if configMeta != nil {
+		config["metadata"] = configMeta
+	}
 
-		if obj.GetName() == "" {
-			return fmt.Errorf("Error fetching one of the %s: it does not have a name set", utils.ResourceNameFor(c.Mapper, obj))
-		}
+	liveAnnos, _ := liveMeta["annotations"].(map[string]interface{})
+	configAnnos, _ := configMeta["annotations"].(map[string]interface{})
+	liveAnnos, configAnnos = copyMap(liveAnnos), copyMap(configAnnos)
+	for _, anno := range lastAppliedAnnotations {
+		redactKey(liveAnnos, configAnnos, anno)
+	}
+	if liveAnnos != nil {
+		liveMeta["annotations"] = liveAnnos
+	}
+	if configAnnos != nil {
+		configMeta["annotations"] = configAnnos
+	}
 
-		liveObj, err := client.Get(obj.GetName(), metav1.GetOptions{})
-		if err != nil && errors.IsNotFound(err) {
-			log.Debugf("%s doesn't exist on the server", desc)
-			liveObj = nil
-		} else if err != nil {
-			return fmt.Errorf("Error fetching %s: %v", desc, err)
-		}
+	return live, config
+}
 
-		fmt.Fprintln(out, "---")
-		fmt.Fprintf(out, "- live %s\n+ config %s\n", desc, desc)
-		if liveObj == nil {
-			fmt.Fprintf(out, "%s doesn't exist on server\n", desc)
-			diffFound = true
-			continue
+// redactPath redacts path within live and config (see
+// redactField), copying any maps along the way.
+func redactPath(live, config map[string]interface{}, path []string) {
+	for _, field := range path[:len(path)-1] {
+		liveVal, liveOk := live[field]
+		configVal, configOk := config[field]
+		liveNext, liveIsMap := liveVal.(map[string]interface{})
+		configNext, configIsMap := configVal.(map[string]interface{})
+		if (liveOk && !liveIsMap) || (configOk && !configIsMap) {
+			// Not a map: redact the whole value
+			redactKey(live, config, field)
+			return
 		}
-
-		liveObjObject := liveObj.Object
-		if c.DiffStrategy == "subset" {
-			liveObjObject = removeMapFields(obj.Object, liveObjObject)
+		if !liveOk && !configOk {
+			return
 		}
 
-		liveObjText, _ := json.MarshalIndent(liveObjObject, "", "  ")
-		objText, _ := json.MarshalIndent(obj.Object, "", "  ")
-
-		liveObjTextLines, objTextLines, lines := dmp.DiffLinesToChars(string(liveObjText), string(objText))
+		liveNext, configNext = copyMap(liveNext), copyMap(configNext)
+		if liveOk {
+			live[field] = liveNext
+		}
+		if configOk {
+			config[field] = configNext
+		}
+		live, config = liveNext, configNext
+	}
+	redactField(live, config, path[len(path)-1])
+}
 
-		diff := dmp.DiffMain(
-			string(liveObjTextLines),
-			string(objTextLines),
-			false)
+// redactField replaces every value of the map at live[field] and
+// config[field] with a placeholder.
+func redactField(live, config map[string]interface{}, field string) {
+	liveData, liveIsMap := live[field].(map[string]interface{})
+	configData, configIsMap := config[field].(map[string]interface{})
+	if !liveIsMap && !configIsMap {
+		// Absent, or not a map: redact the whole value
+		redactKey(live, config, field)
+		return
+	}
 
-		diff = dmp.DiffCharsToLines(diff, lines)
-		if (len(diff) == 1) && (diff[0].Type == diffmatchpatch.DiffEqual) {
-			fmt.Fprintf(out, "%s unchanged\n", desc)
-		} else {
-			diffFound = true
-			text := c.formatDiff(diff, isatty.IsTerminal(os.Stdout.Fd()), c.OmitSecrets && obj.GetKind() == "Secret")
-			fmt.Fprintf(out, "%s\n", text)
+	redactedLive := make(map[string]interface{}, len(liveData))
+	for k := range liveData {
+		redactedLive[k] = omittedValue
+	}
+	redactedConfig := make(map[string]interface{}, len(configData))
+	for k, v := range configData {
+		redactedConfig[k] = omittedValue
+		if lv, ok := liveData[k]; ok && !reflect.DeepEqual(lv, v) {
+			redactedConfig[k] = omittedChangedValue
 		}
 	}
 
-	if diffFound {
-		return ErrDiffFound
+	if _, ok := live[field]; ok {
+		live[field] = redactedLive
+	}
+	if _, ok := config[field]; ok {
+		config[field] = redactedConfig
 	}
-	return nil
 }
 
-// Formats the supplied Diff as a unified-diff-like text with infinite context and optionally colorizes it.
-func (c DiffCmd) formatDiff(diffs []diffmatchpatch.Diff, color bool, omitchanges bool) string {
-	var buff bytes.Buffer
-
-	for _, diff := range diffs {
-		text := diff.Text
-
-		if omitchanges {
-			text = DiffKeyValue.ReplaceAllString(text, "$1: <omitted>")
+// summarizeBinaryData returns copies of the live and config
+// ConfigMaps with each binaryData value replaced by its size, as the
+// base64 is unreadable.  A value that changed but kept its size is
+// marked as changed on the config side.
+func summarizeBinaryData(live, config map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	live, config = copyMap(live), copyMap(config)
+	liveData, _ := live["binaryData"].(map[string]interface{})
+	configData, _ := config["binaryData"].(map[string]interface{})
+	if liveData != nil {
+		summary := make(map[string]interface{}, len(liveData))
+		for k, v := range liveData {
+			summary[k] = fmt.Sprintf("<binary, %d bytes>", binarySize(v))
 		}
-		switch diff.Type {
-		case diffmatchpatch.DiffInsert:
-			if color {
-				_, _ = buff.WriteString("\x1b[32m")
+		live["binaryData"] = summary
+	}
+	if configData != nil {
+		summary := make(map[string]interface{}, len(configData))
+		for k, v := range configData {
+			size := binarySize(v)
+			summary[k] = fmt.Sprintf("<binary, %d bytes>", size)
+			if lv, ok := liveData[k]; ok && binarySize(lv) == size && !reflect.DeepEqual(lv, v) {
+				summary[k] = fmt.Sprintf("<binary, %d bytes (changed)>", size)
+			}
+		}
+		config["binaryData"] = summary
+	}
+	return live, config
+}
+
+// truncateValues returns copies of live and config with every string
+// longer than n characters cut short, see DiffCmd.MaxValueLen.  A
+// string in config that differs from the one at the same path in
+// live only past the cut is marked as changed.
+func truncateValues(live, config interface{}, n int) (interface{}, interface{}) {
+	switch l := live.(type) {
+	case map[string]interface{}:
+		if c, ok := config.(map[string]interface{}); ok {
+			liveResult := make(map[string]interface{}, len(l))
+			configResult := make(map[string]interface{}, len(c))
+			for k, v := range l {
+				if cv, ok := c[k]; ok {
+					liveResult[k], configResult[k] = truncateValues(v, cv, n)
+				} else {
+					liveResult[k] = truncateAll(v, n)
+				}
 			}
-			_, _ = buff.WriteString(DiffLineStart.ReplaceAllString(text, "$1+ $2"))
-			if color {
-				_, _ = buff.WriteString("\x1b[0m")
+			for k, v := range c {
+				if _, ok := l[k]; !ok {
+					configResult[k] = truncateAll(v, n)
+				}
 			}
-		case diffmatchpatch.DiffDelete:
-			if color {
-				_, _ = buff.WriteString("\x1b[31m")
+			return liveResult, configResult
+		}
+	case []interface{}:
+		if c, ok := config.([]interface{}); ok {
+			liveResult := make([]interface{}, len(l))
+			configResult := make([]interface{}, len(c))
+			for i := range l {
+				if i < len(c) {
+					liveResult[i], configResult[i] = truncateValues(l[i], c[i], n)
+				} else {
+					liveResult[i] = truncateAll(l[i], n)
+				}
 			}
-			_, _ = buff.WriteString(DiffLineStart.ReplaceAllString(text, "$1- $2"))
-			if color {
-				_, _ = buff.WriteString("\x1b[0m")
+			for i := len(l); i < len(c); i++ {
+				configResult[i] = truncateAll(c[i], n)
 			}
-		case diffmatchpatch.DiffEqual:
-			if !omitchanges {
-				_, _ = buff.WriteString(DiffLineStart.ReplaceAllString(text, "$1  $2"))
+			return liveResult, configResult
+		}
+	case string:
+		if c, ok := config.(string); ok {
+			liveResult, configResult := truncateString(l, n, false), truncateString(c, n, false)
+			if liveResult == configResult && l != c {
+				configResult = truncateString(c, n, true)
 			}
+			return liveResult, configResult
+		}
+	}
+	return truncateAll(live, n), truncateAll(config, n)
+}
+
+// truncateAll returns a copy of v with every string longer than n
+// characters cut short.
+func truncateAll(v interface{}, n int) interface{} {
+	switch v := v.(type) {
+	case string:
+		return truncateString(v, n, false)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = truncateAll(item, n)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = truncateAll(item, n)
+		}
+		return result
+	}
+	return v
+}
+
+// truncateString returns the first n characters of s, noting its
+// length, if it is any longer.
+func truncateString(s string, n int, changed bool) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if changed {
+		return fmt.Sprintf("%s... (%d chars, changed)", string(r[:n]), len(r))
+	}
+	return fmt.Sprintf("%s... (%d chars)", string(r[:n]), len(r))
+}
+
+// binarySize returns the decoded size of the base64 value v.
+func binarySize(v interface{}) int {
+	s, _ := v.(string)
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return len(b)
+	}
+	return len(s)
+}
+
+// redactKey replaces the value of key in live and config with a
+// placeholder, if present.
+func redactKey(live, config map[string]interface{}, key string) {
+	liveVal, liveOk := live[key]
+	configVal, configOk := config[key]
+	if liveOk {
+		live[key] = omittedValue
+	}
+	if configOk {
+		config[key] = omittedValue
+		if liveOk && !reflect.DeepEqual(liveVal, configVal) {
+			config[key] = omittedChangedValue
 		}
 	}
+}
 
-	return buff.String()
+// copyMap returns a shallow copy of m, or nil if m is nil.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
 }
 
 // See also feature request for golang reflect pkg at
@@ -168,8 +4199,31 @@ func isEmptyValue(i interface{}) bool {
 		return !v
 	case float64:
 		return v == 0
+	case float32:
+		return v == 0
+	case int:
+		return v == 0
+	case int8:
+		return v == 0
+	case int16:
+		return v == 0
+	case int32:
+		return v == 0
 	case int64:
 		return v == 0
+	case uint:
+		return v == 0
+	case uint8:
+		return v == 0
+	case uint16:
+		return v == 0
+	case uint32:
+		return v == 0
+	case uint64:
+		return v == 0
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
 	case string:
 		return v == ""
 	case nil:
@@ -179,21 +4233,24 @@ func isEmptyValue(i interface{}) bool {
 	}
 }
 
-func removeFields(config, live interface{}) interface{} {
+// removeFields returns live without any map fields absent from
+// config.  s is the schema of live, and may be nil (see
+// matchListElements).
+func removeFields(config, live interface{}, s proto.Schema) interface{} {
 	switch c := config.(type) {
 	case map[string]interface{}:
 		if live, ok := live.(map[string]interface{}); ok {
-			return removeMapFields(c, live)
+			return removeMapFields(c, live, s)
 		}
 	case []interface{}:
 		if live, ok := live.([]interface{}); ok {
-			return removeListFields(c, live)
+			return removeListFields(c, live, s)
 		}
 	}
 	return live
 }
 
-func removeMapFields(config, live map[string]interface{}) map[string]interface{} {
+func removeMapFields(config, live map[string]interface{}, s proto.Schema) map[string]interface{} {
 	result := map[string]interface{}{}
 	for k, v1 := range config {
 		v2, ok := live[k]
@@ -205,21 +4262,449 @@ func removeMapFields(config, live map[string]interface{}) map[string]interface{}
 			}
 			continue
 		}
-		result[k] = removeFields(v1, v2)
+		result[k] = removeFields(v1, v2, fieldSchema(s, k))
 	}
 	return result
 }
 
-func removeListFields(config, live []interface{}) []interface{} {
-	// If live is longer than config, then the extra elements at the end of the
-	// list will be returned as is so they appear in the diff.
+// restoreFields returns the result of removeFields on live, with the
+// fields it removed added back in.
+func restoreFields(removed, live interface{}) interface{} {
+	switch r := removed.(type) {
+	case map[string]interface{}:
+		if live, ok := live.(map[string]interface{}); ok {
+			result := make(map[string]interface{}, len(live))
+			for k, v := range r {
+				result[k] = v
+			}
+			for k, v := range live {
+				if rv, ok := r[k]; ok {
+					result[k] = restoreFields(rv, v)
+				} else {
+					result[k] = v
+				}
+			}
+			return result
+		}
+	case []interface{}:
+		// removeListFields keeps every live element, in order
+		if live, ok := live.([]interface{}); ok && len(live) == len(r) {
+			result := make([]interface{}, len(r))
+			for i := range r {
+				result[i] = restoreFields(r[i], live[i])
+			}
+			return result
+		}
+	}
+	return removed
+}
+
+func removeListFields(config, live []interface{}, s proto.Schema) []interface{} {
+	// If live has elements with no counterpart in config (eg: extra
+	// elements at the end of the list), they will be returned as
+	// is so they appear in the diff.
+	matched := matchListElements(config, live, s)
+	elemSchema := elementSchema(s)
 	result := make([]interface{}, 0, len(live))
 	for i, v2 := range live {
-		if len(config) > i {
-			result = append(result, removeFields(config[i], v2))
+		result = append(result, removeFields(matched[i], v2, elemSchema))
+	}
+	return result
+}
+
+// patchMergeKeyExtension names the list element field that
+// identifies elements during a strategic merge
+const patchMergeKeyExtension = "x-kubernetes-patch-merge-key"
+
+// matchListElements returns the element of config corresponding to
+// each element of live, or nil if there is none.  Elements are
+// matched by the patch merge key from the list schema s (eg: "name"
+// for containers) if it has one, and by position otherwise.
+func matchListElements(config, live []interface{}, s proto.Schema) []interface{} {
+	matched := make([]interface{}, len(live))
+
+	key := listMergeKey(s)
+	if key == "" {
+		for i := range live {
+			if i < len(config) {
+				matched[i] = config[i]
+			}
+		}
+		return matched
+	}
+
+	byKey := make(map[interface{}]interface{}, len(config))
+	for _, v := range config {
+		if k, ok := mergeKeyValue(v, key); ok {
+			byKey[k] = v
+		}
+	}
+	for i, v := range live {
+		if k, ok := mergeKeyValue(v, key); ok {
+			matched[i] = byKey[k]
+		}
+	}
+	return matched
+}
+
+// listMergeKey returns the patch merge key of the list schema s, or
+// "" if it has none.
+func listMergeKey(s proto.Schema) string {
+	if s, ok := deref(s).(*proto.Array); ok {
+		key, _ := s.GetExtensions()[patchMergeKeyExtension].(string)
+		return key
+	}
+	return ""
+}
+
+// orderListElements returns live with the elements of each list that
+// has a patch merge key (eg: containers, initContainers) rearranged
+// into the order of the matching config elements, so reordering a
+// list in config alone isn't reported as a change.  Live elements
+// without a counterpart in config follow, in their original order.
+func orderListElements(config, live interface{}, s proto.Schema) interface{} {
+	switch c := config.(type) {
+	case map[string]interface{}:
+		if live, ok := live.(map[string]interface{}); ok {
+			result := make(map[string]interface{}, len(live))
+			for k, v := range live {
+				if cv, ok := c[k]; ok {
+					v = orderListElements(cv, v, fieldSchema(s, k))
+				}
+				result[k] = v
+			}
+			return result
+		}
+	case []interface{}:
+		if live, ok := live.([]interface{}); ok {
+			if key := listMergeKey(s); key != "" {
+				live = orderByMergeKey(c, live, key)
+			}
+			matched := matchListElements(c, live, s)
+			elemSchema := elementSchema(s)
+			result := make([]interface{}, len(live))
+			for i, v := range live {
+				result[i] = orderListElements(matched[i], v, elemSchema)
+			}
+			return result
+		}
+	}
+	return live
+}
+
+// orderByMergeKey returns the elements of live matching an element
+// of config by field key in config order, followed by the rest.
+func orderByMergeKey(config, live []interface{}, key string) []interface{} {
+	byKey := make(map[interface{}]int, len(live))
+	for i, v := range live {
+		if k, ok := mergeKeyValue(v, key); ok {
+			if _, dup := byKey[k]; !dup {
+				byKey[k] = i
+			}
+		}
+	}
+	used := make([]bool, len(live))
+	result := make([]interface{}, 0, len(live))
+	for _, v := range config {
+		k, ok := mergeKeyValue(v, key)
+		if !ok {
+			continue
+		}
+		if i, ok := byKey[k]; ok && !used[i] {
+			used[i] = true
+			result = append(result, live[i])
+		}
+	}
+	for i, v := range live {
+		if !used[i] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// mergeKeyValue returns the (primitive) value of field key of the
+// list element v.
+func mergeKeyValue(v interface{}, key string) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	switch k := m[key].(type) {
+	case string, bool, int64, float64:
+		return k, true
+	}
+	return nil, false
+}
+
+// deref resolves references to their underlying schema.
+func deref(s proto.Schema) proto.Schema {
+	if ref, ok := s.(proto.Reference); ok {
+		return ref.SubSchema()
+	}
+	return s
+}
+
+// fieldSchema returns the schema of field k of the map or object
+// schema s, or nil.
+func fieldSchema(s proto.Schema, k string) proto.Schema {
+	switch s := deref(s).(type) {
+	case *proto.Kind:
+		return s.Fields[k]
+	case *proto.Map:
+		return s.SubType
+	}
+	return nil
+}
+
+// elementSchema returns the schema of the elements of the list
+// schema s, or nil.
+func elementSchema(s proto.Schema) proto.Schema {
+	if s, ok := deref(s).(*proto.Array); ok {
+		return s.SubType
+	}
+	return nil
+}
+
+// jsonLinePaths returns the field path of each line of text, as
+// produced by marshalIndent, eg: "spec.containers[0].name".  Lines
+// that open or close a map or list have the path of that map or
+// list.
+func jsonLinePaths(text string) []string {
+	type frame struct {
+		path  string
+		list  bool
+		index int
+	}
+	var stack []frame
+	var paths []string
+
+	for _, line := range strings.Split(text, "\n") {
+		t := strings.TrimSpace(line)
+		if len(stack) == 0 {
+			// Top level value
+			paths = append(paths, "")
+			if t == "{" || t == "[" {
+				stack = append(stack, frame{list: t == "["})
+			}
+			continue
+		}
+
+		top := &stack[len(stack)-1]
+		if strings.HasPrefix(t, "}") || strings.HasPrefix(t, "]") {
+			paths = append(paths, top.path)
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && stack[len(stack)-1].list {
+				stack[len(stack)-1].index++
+			}
+			continue
+		}
+
+		var path, value string
+		if top.list {
+			path = fmt.Sprintf("%s[%d]", top.path, top.index)
+			value = t
+		} else {
+			key, rest := splitJSONKey(t)
+			path = key
+			if top.path != "" {
+				path = top.path + "." + key
+			}
+			value = rest
+		}
+		paths = append(paths, path)
+
+		if opensJSON(value) {
+			stack = append(stack, frame{path: path, list: value[0] == '['})
+		} else if top.list {
+			top.index++
+		}
+	}
+	return paths
+}
+
+// opensJSON returns true if value, from a line of marshalIndent
+// output, opens a non-empty map or list.  Lines may have trailing
+// text added, see annotateManagers.
+func opensJSON(value string) bool {
+	switch {
+	case strings.HasPrefix(value, "{}"), strings.HasPrefix(value, "[]"):
+		return false
+	}
+	return strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[")
+}
+
+// splitJSONKey splits a `"key": value` line into the (unquoted) key
+// and value.
+func splitJSONKey(line string) (string, string) {
+	escaped := false
+	for i := 1; i < len(line); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case line[i] == '\\':
+			escaped = true
+		case line[i] == '"':
+			var key string
+			if err := json.Unmarshal([]byte(line[:i+1]), &key); err != nil {
+				return line, ""
+			}
+			return key, strings.TrimPrefix(line[i+1:], ": ")
+		}
+	}
+	return line, ""
+}
+
+// fieldOwners returns the manager owning each field of live (by
+// jsonLinePaths path), according to its metadata.managedFields.
+func fieldOwners(live map[string]interface{}) map[string]string {
+	owners := map[string]string{}
+	entries, _, _ := unstructured.NestedSlice(live, "metadata", "managedFields")
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		manager, _ := entry["manager"].(string)
+		fields, ok := entry["fieldsV1"].(map[string]interface{})
+		if !ok {
+			// Before fieldsType was introduced
+			fields, _ = entry["fields"].(map[string]interface{})
+		}
+		addFieldOwners(owners, fields, live, "", manager)
+	}
+	return owners
+}
+
+// addFieldOwners records manager as the owner of each field in the
+// managed fields set fields, relative to the value v at path.
+func addFieldOwners(owners map[string]string, fields map[string]interface{}, v interface{}, path, manager string) {
+	for k, sub := range fields {
+		if k == "." {
+			owners[path] = manager
+			continue
+		}
+
+		var childPath string
+		var child interface{}
+		switch {
+		case strings.HasPrefix(k, "f:"):
+			m, _ := v.(map[string]interface{})
+			child = m[k[2:]]
+			childPath = k[2:]
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+		case strings.HasPrefix(k, "k:"), strings.HasPrefix(k, "v:"), strings.HasPrefix(k, "i:"):
+			list, _ := v.([]interface{})
+			i := listIndexFor(list, k)
+			if i < 0 {
+				continue
+			}
+			child = list[i]
+			childPath = fmt.Sprintf("%s[%d]", path, i)
+		default:
+			continue
+		}
+
+		if subFields, ok := sub.(map[string]interface{}); ok && len(subFields) > 0 {
+			addFieldOwners(owners, subFields, child, childPath, manager)
 		} else {
-			result = append(result, v2)
+			owners[childPath] = manager
+		}
+	}
+}
+
+// listIndexFor returns the index of the list element identified by
+// the managed fields key k (k:{keys}, v:value or i:index), or -1.
+func listIndexFor(list []interface{}, k string) int {
+	if k[0] == 'i' {
+		i, err := strconv.Atoi(k[2:])
+		if err != nil || i < 0 || i >= len(list) {
+			return -1
+		}
+		return i
+	}
+
+	var id interface{}
+	if err := json.Unmarshal([]byte(k[2:]), &id); err != nil {
+		return -1
+	}
+	id = normalizeNumbers(id)
+	for i, elem := range list {
+		if k[0] == 'v' {
+			if reflect.DeepEqual(elem, id) {
+				return i
+			}
+			continue
+		}
+		keys, _ := id.(map[string]interface{})
+		m, _ := elem.(map[string]interface{})
+		match := m != nil
+		for key, value := range keys {
+			if !reflect.DeepEqual(m[key], value) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// ownerOf returns the owner of path, or of its closest owned
+// parent.
+func ownerOf(owners map[string]string, path string) string {
+	for {
+		if manager, ok := owners[path]; ok {
+			return manager
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return ""
+		}
+		path = path[:i]
+	}
+}
+
+// annotateManagers appends the owning manager (if any) to each
+// changed line of diffs, between liveText and configText.
+func annotateManagers(diffs []diffmatchpatch.Diff, liveText, configText string, owners map[string]string) []diffmatchpatch.Diff {
+	livePaths := jsonLinePaths(liveText)
+	configPaths := jsonLinePaths(configText)
+	liveLine, configLine := 0, 0
+
+	result := make([]diffmatchpatch.Diff, len(diffs))
+	for i, diff := range diffs {
+		var buff bytes.Buffer
+		for _, line := range strings.SplitAfter(diff.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			var path string
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				liveLine++
+				configLine++
+				buff.WriteString(line)
+				continue
+			case diffmatchpatch.DiffDelete:
+				path = livePaths[liveLine]
+				liveLine++
+			case diffmatchpatch.DiffInsert:
+				path = configPaths[configLine]
+				configLine++
+			}
+			if manager := ownerOf(owners, path); manager != "" {
+				text := strings.TrimSuffix(line, "\n")
+				fmt.Fprintf(&buff, "%s  (manager: %s)%s", text, manager, line[len(text):])
+			} else {
+				buff.WriteString(line)
+			}
 		}
+		result[i] = diffmatchpatch.Diff{Type: diff.Type, Text: buff.String()}
 	}
 	return result
 }
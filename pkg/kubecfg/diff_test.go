@@ -16,11 +16,232 @@
 package kubecfg
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
+	pb_proto "github.com/golang/protobuf/proto"
+	"github.com/googleapis/gnostic/OpenAPIv2"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/bitnami/kubecfg/utils"
 )
 
+// fakeDynamic is a minimal dynamic.Interface serving Get and List
+// requests from an in-memory set of objects.
+type fakeDynamic struct {
+	objects map[string]*unstructured.Unstructured
+	// patchErr, if set, is returned by Patch
+	patchErr error
+}
+
+func newFakeDynamic(objs ...*unstructured.Unstructured) *fakeDynamic {
+	f := &fakeDynamic{objects: map[string]*unstructured.Unstructured{}}
+	for _, o := range objs {
+		gvr, _ := meta.UnsafeGuessKindToResource(o.GroupVersionKind())
+		f.objects[fakeKey(gvr, o.GetNamespace(), o.GetName())] = o
+	}
+	return f
+}
+
+func fakeKey(gvr schema.GroupVersionResource, ns, name string) string {
+	return fmt.Sprintf("%s/%s/%s", gvr, ns, name)
+}
+
+func (f *fakeDynamic) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeResource{client: f, gvr: gvr}
+}
+
+type fakeResource struct {
+	client    *fakeDynamic
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+var errFakeUnsupported = fmt.Errorf("not supported by fake client")
+
+func (r *fakeResource) Namespace(ns string) dynamic.ResourceInterface {
+	return &fakeResource{client: r.client, gvr: r.gvr, namespace: ns}
+}
+
+func (r *fakeResource) Get(name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	obj, ok := r.client.objects[fakeKey(r.gvr, r.namespace, name)]
+	if !ok {
+		return nil, errors.NewNotFound(r.gvr.GroupResource(), name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (r *fakeResource) Create(obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	return nil, errFakeUnsupported
+}
+
+func (r *fakeResource) Update(obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	return nil, errFakeUnsupported
+}
+
+func (r *fakeResource) UpdateStatus(obj *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	return nil, errFakeUnsupported
+}
+
+func (r *fakeResource) Delete(name string, options *metav1.DeleteOptions, subresources ...string) error {
+	return errFakeUnsupported
+}
+
+func (r *fakeResource) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	return errFakeUnsupported
+}
+
+func (r *fakeResource) List(opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &unstructured.UnstructuredList{}
+	for _, o := range r.client.objects {
+		gvr, _ := meta.UnsafeGuessKindToResource(o.GroupVersionKind())
+		if gvr == r.gvr && (r.namespace == "" || r.namespace == o.GetNamespace()) && selector.Matches(labels.Set(o.GetLabels())) {
+			list.Items = append(list.Items, *o.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (r *fakeResource) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return nil, errFakeUnsupported
+}
+
+// Patch supports dry-run JSON merge patches, simulating a mutating
+// webhook that adds a "mutated" label
+func (r *fakeResource) Patch(name string, pt types.PatchType, data []byte, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if pt != types.MergePatchType || len(options.DryRun) != 1 || options.DryRun[0] != metav1.DryRunAll {
+		return nil, errFakeUnsupported
+	}
+	if r.client.patchErr != nil {
+		return nil, r.client.patchErr
+	}
+	obj, err := r.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	orig, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patched, err := jsonpatch.MergePatch(orig, data)
+	if err != nil {
+		return nil, err
+	}
+	result := &unstructured.Unstructured{}
+	if err := result.UnmarshalJSON(patched); err != nil {
+		return nil, err
+	}
+	labels := result.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["mutated"] = "true"
+	result.SetLabels(labels)
+	return result, nil
+}
+
+func newFakeMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{
+		{Version: "v1"},
+		{Group: "apps", Version: "v1"},
+		{Group: "rbac.authorization.k8s.io", Version: "v1"},
+	})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	return mapper
+}
+
+func configMap(ns, name string, data map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": ns,
+			},
+			"data": data,
+		},
+	}
+}
+
+func TestDiffResult(t *testing.T) {
+	live := []*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+	}
+	config := []*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "baz"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "new", map[string]interface{}{"foo": "bar"}),
+	}
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live...),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: "all",
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff(config, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	require.Equal(t, []ObjectDiff{
+		{GroupVersionKind: gvk, Namespace: "ns", Name: "changed", Status: DiffStatusChanged, Added: 1, Removed: 1},
+		{GroupVersionKind: gvk, Namespace: "ns", Name: "new", Status: DiffStatusCreated},
+		{GroupVersionKind: gvk, Namespace: "ns", Name: "same", Status: DiffStatusUnchanged},
+	}, result.Objects)
+	require.Equal(t, 1, result.Count(DiffStatusChanged))
+	require.Equal(t, 1, result.Count(DiffStatusCreated))
+	require.Equal(t, 1, result.Count(DiffStatusUnchanged))
+
+	selected := result.SelectObjects([]int{0, 1, -1, 3})
+	require.Len(t, selected, 2)
+	require.Equal(t, "changed", selected[0].GetName())
+	require.Equal(t, "new", selected[1].GetName())
+	require.Empty(t, result.SelectObjects(nil))
+
+	result, err = c.Diff([]*unstructured.Unstructured{live[1]}, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Count(DiffStatusUnchanged))
+}
+
 func TestRemoveListFields(t *testing.T) {
 	for _, tc := range []struct {
 		config, live, expected []interface{}
@@ -45,7 +266,7 @@ func TestRemoveListFields(t *testing.T) {
 			expected: []interface{}{"a", "b"},
 		},
 	} {
-		require.EqualValues(t, tc.expected, removeListFields(tc.config, tc.live))
+		require.EqualValues(t, tc.expected, removeListFields(tc.config, tc.live, nil))
 	}
 }
 
@@ -71,7 +292,26 @@ func TestRemoveMapFields(t *testing.T) {
 			expected: map[string]interface{}{"foo": "bar"},
 		},
 	} {
-		require.Equal(t, tc.expected, removeMapFields(tc.config, tc.live))
+		require.Equal(t, tc.expected, removeMapFields(tc.config, tc.live, nil))
+	}
+}
+
+func TestIsEmptyValue(t *testing.T) {
+	for _, zero := range []interface{}{
+		0, int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), json.Number("0"), json.Number("0.0"),
+		"", false, nil, []interface{}{}, []string{}, map[string]interface{}{},
+	} {
+		require.True(t, isEmptyValue(zero), "%T", zero)
+	}
+	for _, nonZero := range []interface{}{
+		1, int8(1), int16(1), int32(1), int64(1),
+		uint(1), uint8(1), uint16(1), uint32(1), uint64(1),
+		float32(0.5), float64(0.5), json.Number("1"), json.Number("x"),
+		"x", true, []interface{}{nil}, []string{""}, map[string]interface{}{"": nil},
+	} {
+		require.False(t, isEmptyValue(nonZero), "%T", nonZero)
 	}
 }
 
@@ -193,6 +433,3575 @@ func TestRemoveFields(t *testing.T) {
 			},
 		},
 	} {
-		require.Equal(t, tc.expected, removeFields(tc.config, tc.live))
+		require.Equal(t, tc.expected, removeFields(tc.config, tc.live, nil))
+	}
+}
+
+func TestDiffShowExtraLiveFields(t *testing.T) {
+	live := deployment("ns", "web", int64(1))
+	live.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "web", "image": "web:1", "terminationMessagePath": "/dev/termination-log"},
+			},
+		},
+	}
+	config := deployment("ns", "web", int64(1))
+	config.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "web", "image": "web:1", "args": []interface{}{}},
+			},
+		},
+	}
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: "subset",
+		Context:      -1,
+	}
+	var buf bytes.Buffer
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+
+	buf.Reset()
+	c.ShowExtraLiveFields = true
+	err := c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	output := buf.String()
+	require.Contains(t, output, `-             "terminationMessagePath": "/dev/termination-log"`)
+	// Empty values in config still match missing live fields
+	require.Contains(t, output, `              "args": [],`)
+}
+
+func TestDiffAllObjects(t *testing.T) {
+	for _, strategy := range []string{"all", "subset"} {
+		c := DiffCmd{
+			Client: newFakeDynamic(
+				configMap("ns", "a", map[string]interface{}{"foo": "old-a"}),
+				configMap("ns", "b", map[string]interface{}{"foo": "old-b"}),
+			),
+			Mapper:       newFakeMapper(),
+			DiffStrategy: strategy,
+		}
+
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{
+			configMap("ns", "a", map[string]interface{}{"foo": "new-a"}),
+			configMap("ns", "b", map[string]interface{}{"foo": "new-b"}),
+		}, &buf)
+		require.Equal(t, ErrModifications, err)
+
+		// Every object should be diffed, not just the first.
+		for _, s := range []string{"old-a", "new-a", "old-b", "new-b"} {
+			require.Contains(t, buf.String(), s, "strategy %s", strategy)
+		}
+	}
+}
+
+func TestFormatSideBySide(t *testing.T) {
+	diffs := []diffmatchpatch.Diff{
+		{Type: diffmatchpatch.DiffEqual, Text: "{\n"},
+		{Type: diffmatchpatch.DiffDelete, Text: "  \"a\": 1,\n  \"b\": \"a-very-long-value\"\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "  \"a\": 2\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "}"},
+	}
+
+	c := DiffCmd{Layout: DiffLayoutSideBySide, Width: 43, Context: -1}
+	expected := "  {                  |   {\n" +
+		"-   \"a\": 1,          | +   \"a\": 2\n" +
+		"-   \"b\": \"a-very-lon | \n" +
+		"  }                  |   }"
+	require.Equal(t, expected, c.formatDiff(diffs, false))
+
+	colored := c.formatDiff(diffs, true)
+	require.Contains(t, colored, "\x1b[31m-   \"a\": 1,         \x1b[0m | \x1b[32m+   \"a\": 2\x1b[0m\n")
+}
+
+func TestFormatWordDiff(t *testing.T) {
+	diffs := []diffmatchpatch.Diff{
+		{Type: diffmatchpatch.DiffEqual, Text: "{\n"},
+		{Type: diffmatchpatch.DiffDelete, Text: "  \"image\": \"nginx:1.15\",\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "  \"image\": \"nginx:1.16\",\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "  \"name\": \"web\"\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "  \"port\": 80\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "}"},
+	}
+
+	c := DiffCmd{Granularity: DiffGranularityWord, Context: -1}
+	expected := "  {\n" +
+		"\x1b[31m-   \"image\": \"nginx:1.1\x1b[7m5\x1b[27m\",\x1b[0m\n" +
+		"\x1b[32m+   \"image\": \"nginx:1.1\x1b[7m6\x1b[27m\",\x1b[0m\n" +
+		"    \"name\": \"web\"\n" +
+		"\x1b[32m+   \"port\": 80\n\x1b[0m" +
+		"  }"
+	require.Equal(t, expected, c.formatDiff(diffs, true))
+
+	// Falls back to lines without color
+	line := DiffCmd{Context: -1}
+	require.Equal(t, line.formatDiff(diffs, false), c.formatDiff(diffs, false))
+}
+
+func TestFormatDiffContext(t *testing.T) {
+	diffs := []diffmatchpatch.Diff{
+		{Type: diffmatchpatch.DiffEqual, Text: "1\n2\n3\n4\n"},
+		{Type: diffmatchpatch.DiffDelete, Text: "5\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "five\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "6\n7\n8\n9\n10\n11\n12\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "13\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "14"},
+	}
+
+	c := DiffCmd{Context: 1}
+	expected := "@@ -4,3 +4,3 @@\n" +
+		"  4\n" +
+		"- 5\n" +
+		"+ five\n" +
+		"  6\n" +
+		"@@ -12,2 +12,3 @@\n" +
+		"  12\n" +
+		"+ 13\n" +
+		"  14"
+	require.Equal(t, expected, c.formatDiff(diffs, false))
+
+	// Changes closer than 2*Context are merged into one hunk
+	c.Context = 4
+	require.Contains(t, c.formatDiff(diffs, false), "@@ -1,13 +1,14 @@\n")
+
+	c.Context = -1
+	require.Equal(t, 14, strings.Count(c.formatDiff(diffs, false), "\n"))
+}
+
+// chunkWriter records each Write separately
+type chunkWriter struct {
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func TestWriteDiff(t *testing.T) {
+	diffs := []diffmatchpatch.Diff{
+		{Type: diffmatchpatch.DiffEqual, Text: "{\n"},
+		{Type: diffmatchpatch.DiffDelete, Text: "  \"a\": 1\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "  \"a\": 2\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "}"},
+	}
+
+	for _, c := range []DiffCmd{
+		{Context: -1},
+		{Context: 0},
+		{Context: -1, Layout: DiffLayoutSideBySide, Width: 40},
+	} {
+		var w chunkWriter
+		require.NoError(t, c.writeDiff(&w, diffs, ansiMarkup))
+		require.True(t, len(w.chunks) > 1, "output should be streamed")
+		require.Equal(t, c.formatDiff(diffs, true)+"\n", strings.Join(w.chunks, ""))
+	}
+
+	require.Error(t, DiffCmd{Context: -1}.writeDiff(errWriter{}, diffs, nil))
+}
+
+func TestDiffWriteError(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+	}
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+	require.EqualError(t, c.Run([]*unstructured.Unstructured{config}, errWriter{}), "write failed")
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func secret(ns, name string, data map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": ns,
+			},
+			"type": "Opaque",
+			"data": data,
+		},
+	}
+}
+
+func TestDiffBinaryData(t *testing.T) {
+	withBinary := func(obj *unstructured.Unstructured, data map[string]string) *unstructured.Unstructured {
+		binary := map[string]interface{}{}
+		for k, v := range data {
+			binary[k] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		obj.Object["binaryData"] = binary
+		return obj
+	}
+	live := withBinary(configMap("ns", "cm", nil), map[string]string{
+		"same": "abc", "changed": "abcd", "resized": "ab", "removed": "x",
+	})
+	config := withBinary(configMap("ns", "cm", nil), map[string]string{
+		"same": "abc", "changed": "wxyz", "resized": "abcdef", "added": "new",
+	})
+	c := DiffCmd{
+		Client:  newFakeDynamic(live),
+		Mapper:  newFakeMapper(),
+		Context: -1,
+	}
+
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output := buf.String()
+	require.Contains(t, output, `+     "added": "<binary, 3 bytes>"`)
+	require.Contains(t, output, `-     "changed": "<binary, 4 bytes>"`)
+	require.Contains(t, output, `+     "changed": "<binary, 4 bytes (changed)>"`)
+	require.Contains(t, output, `-     "removed": "<binary, 1 bytes>"`)
+	require.Contains(t, output, `-     "resized": "<binary, 2 bytes>"`)
+	require.Contains(t, output, `+     "resized": "<binary, 6 bytes>"`)
+	require.Contains(t, output, `      "same": "<binary, 3 bytes>"`)
+	require.NotContains(t, output, base64.StdEncoding.EncodeToString([]byte("abcd")))
+
+	c.OmitSecrets = true
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output = buf.String()
+	require.Contains(t, output, `+     "added": "<omitted>"`)
+	require.Contains(t, output, `+     "changed": "<omitted (changed)>"`)
+	require.Contains(t, output, `-     "removed": "<omitted>"`)
+	require.Contains(t, output, `+     "resized": "<omitted (changed)>"`)
+	require.Contains(t, output, `      "same": "<omitted>"`)
+
+	// Unchanged binary data is still unchanged
+	require.NoError(t, c.Run([]*unstructured.Unstructured{live.DeepCopy()}, ioutil.Discard))
+}
+
+func TestDiffOmitSecrets(t *testing.T) {
+	live := secret("ns", "s", map[string]interface{}{
+		"slash":     "c2VjcmV0/Zm9v",
+		"same":      "dW5jaGFuZ2Vk==",
+		"removed":   "cmVtb3ZlZA==",
+		"multiline": "line1\nline2",
+	})
+	utils.SetMetaDataAnnotation(live, "kubectl.kubernetes.io/last-applied-configuration", `{"data":{"slash":"c2VjcmV0/Zm9v"}}`)
+	config := secret("ns", "s", map[string]interface{}{
+		"slash":     "bmV3/c2VjcmV0",
+		"same":      "dW5jaGFuZ2Vk==",
+		"added":     "YWRkZWQ=",
+		"multiline": "line1\nline3",
+	})
+	config.Object["stringData"] = map[string]interface{}{"plain": "hunter2"}
+
+	c := DiffCmd{
+		Client:      newFakeDynamic(live),
+		Mapper:      newFakeMapper(),
+		OmitSecrets: true,
+		Context:     -1,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	output := buf.String()
+	for _, leaked := range []string{"c2VjcmV0", "bmV3", "dW5jaGFuZ2Vk", "cmVtb3ZlZA", "YWRkZWQ", "line1", "line2", "line3", "hunter2"} {
+		require.NotContains(t, output, leaked)
+	}
+	require.Contains(t, output, `-     "removed": "<omitted>",`)
+	require.Contains(t, output, `+     "added": "<omitted>",`)
+	require.Contains(t, output, `+     "slash": "<omitted (changed)>"`)
+	require.Contains(t, output, `+     "multiline": "<omitted (changed)>",`)
+	require.Contains(t, output, `      "same": "<omitted>",`)
+	require.Contains(t, output, `+     "plain": "<omitted>"`)
+
+	// Caller's objects are left untouched
+	require.Equal(t, "hunter2", config.Object["stringData"].(map[string]interface{})["plain"])
+
+	// Secrets are shown in full when not omitted
+	buf.Reset()
+	c.OmitSecrets = false
+	_ = c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.Contains(t, buf.String(), "hunter2")
+}
+
+func TestDiffTypedSecrets(t *testing.T) {
+	tlsSecret := func(key, cert string) *unstructured.Unstructured {
+		obj := secret("ns", "tls", map[string]interface{}{"tls.key": key, "tls.crt": cert})
+		obj.Object["type"] = "kubernetes.io/tls"
+		return obj
+	}
+	// A non-Secret carrying typed secret keys
+	live := configMap("ns", "cm", map[string]interface{}{"tls.key": "old-key", "other": "old"})
+	live.Object["spec"] = map[string]interface{}{
+		"pullSecrets": []interface{}{map[string]interface{}{".dockerconfigjson": "old-auth"}},
+	}
+	config := configMap("ns", "cm", map[string]interface{}{"tls.key": "new-key", "other": "new"})
+	config.Object["spec"] = map[string]interface{}{
+		"pullSecrets": []interface{}{map[string]interface{}{".dockerconfigjson": "new-auth"}},
+	}
+
+	c := DiffCmd{
+		Client:      newFakeDynamic(tlsSecret("old-key", "old-cert"), live),
+		Mapper:      newFakeMapper(),
+		OmitSecrets: true,
+		Context:     -1,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{tlsSecret("new-key", "new-cert"), config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	output := buf.String()
+	for _, leaked := range []string{"old-key", "new-key", "old-auth", "new-auth"} {
+		require.NotContains(t, output, leaked)
+	}
+	require.Contains(t, output, `+     "tls.crt": "new-cert",`)
+	require.Contains(t, output, `+     "tls.key": "<omitted (changed)>"`)
+	require.Contains(t, output, `+         ".dockerconfigjson": "<omitted (changed)>"`)
+	require.Contains(t, output, `+     "other": "new",`)
+
+	buf.Reset()
+	c.RedactPublicCerts = true
+	_ = c.Run([]*unstructured.Unstructured{tlsSecret("new-key", "new-cert")}, &buf)
+	require.NotContains(t, buf.String(), "new-cert")
+	require.Contains(t, buf.String(), `+     "tls.crt": "<omitted (changed)>",`)
+}
+
+func TestDiffSecretKeysDeterministic(t *testing.T) {
+	liveData := map[string]interface{}{}
+	configData := map[string]interface{}{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		liveData[key] = "c2FtZQ=="
+		configData[key] = "c2FtZQ=="
+	}
+	liveData["removed"] = "b2xk"
+	liveData["key07"] = "b2xk"
+	configData["key07"] = "bmV3"
+	configData["added"] = "bmV3"
+
+	for _, serialization := range []string{"json", "yaml"} {
+		c := DiffCmd{
+			Client:        newFakeDynamic(secret("ns", "s", liveData)),
+			Mapper:        newFakeMapper(),
+			OmitSecrets:   true,
+			Serialization: serialization,
+		}
+
+		var first string
+		for i := 0; i < 5; i++ {
+			var buf bytes.Buffer
+			err := c.Run([]*unstructured.Unstructured{secret("ns", "s", configData)}, &buf)
+			require.Equal(t, ErrModifications, err)
+			if i == 0 {
+				first = buf.String()
+				continue
+			}
+			require.Equal(t, first, buf.String(), "serialization %s", serialization)
+		}
+
+		if serialization == "yaml" {
+			require.Contains(t, first, "+   added: <omitted>\n")
+			require.Contains(t, first, "+   key07: <omitted (changed)>\n")
+			require.Contains(t, first, "-   removed: <omitted>\n")
+		} else {
+			require.Contains(t, first, `+     "added": "<omitted>",`)
+			require.Contains(t, first, `+     "key07": "<omitted (changed)>",`)
+			require.Contains(t, first, `-     "removed": "<omitted>"`)
+		}
+		require.NotContains(t, first, "key06")
+	}
+}
+
+func TestDiffSecretRedactMode(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			secret("ns", "changed", map[string]interface{}{"old-key": "aHVudGVyMg=="}),
+			secret("ns", "same", map[string]interface{}{"key": "aHVudGVyMg=="}),
+		),
+		Mapper:           newFakeMapper(),
+		OmitSecrets:      true,
+		SecretRedactMode: SecretRedactFull,
+		Context:          -1,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		secret("ns", "changed", map[string]interface{}{"new-key": "aHVudGVyMg=="}),
+		secret("ns", "same", map[string]interface{}{"key": "aHVudGVyMg=="}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+
+	output := buf.String()
+	for _, leaked := range []string{"old-key", "new-key", "aHVudGVyMg"} {
+		require.NotContains(t, output, leaked)
+	}
+	require.Contains(t, output, "-   \"data\": \"<omitted>\",\n+   \"data\": \"<omitted (changed)>\",\n")
+
+	c.SecretRedactMode = "bogus"
+	require.EqualError(t, c.Run(nil, &buf), `Unknown secret redact mode "bogus"`)
+}
+
+func TestDiffSensitiveAnnotation(t *testing.T) {
+	const anno = "kubecfg.bitnami.com/sensitive"
+
+	live := configMap("ns", "creds", map[string]interface{}{"password": "hunter2"})
+	live.Object["spec"] = map[string]interface{}{
+		"token": "old-token",
+		"other": "visible",
+	}
+	utils.SetMetaDataAnnotation(live, "kubectl.kubernetes.io/last-applied-configuration", `{"data":{"password":"hunter2"}}`)
+	config := configMap("ns", "creds", map[string]interface{}{"password": "hunter3"})
+	config.Object["spec"] = map[string]interface{}{
+		"token": "new-token",
+		"other": "visible",
+	}
+	plain := configMap("ns", "plain", map[string]interface{}{"password": "exposed"})
+
+	c := DiffCmd{
+		Client:              newFakeDynamic(live, configMap("ns", "plain", nil)),
+		Mapper:              newFakeMapper(),
+		SensitiveAnnotation: anno,
+		Context:             -1,
+	}
+
+	for _, value := range []string{"true", "data, spec.token"} {
+		utils.SetMetaDataAnnotation(config, anno, value)
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{config, plain}, &buf)
+		require.Equal(t, ErrModifications, err)
+
+		output := buf.String()
+		for _, leaked := range []string{"hunter2", "hunter3"} {
+			require.NotContains(t, output, leaked, "value %q", value)
+		}
+		require.Contains(t, output, `+     "password": "<omitted (changed)>"`)
+		require.Contains(t, output, "exposed")
+		require.Contains(t, output, "visible")
+		if value == "true" {
+			require.Contains(t, output, "new-token")
+		} else {
+			require.NotContains(t, output, "new-token")
+			require.NotContains(t, output, "old-token")
+		}
+	}
+
+	utils.SetMetaDataAnnotation(config, anno, "spec..token")
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+}
+
+func TestDiffThreeWay(t *testing.T) {
+	applied := configMap("ns", "cm", map[string]interface{}{
+		"kept":    "old",
+		"removed": "gone",
+	})
+	live := applied.DeepCopy()
+	addOrigAnnotation(live)
+	live.Object["data"].(map[string]interface{})["server"] = "added-by-controller"
+	config := configMap("ns", "cm", map[string]interface{}{"kept": "new"})
+
+	for _, tc := range []struct {
+		discovery discovery.DiscoveryInterface
+		noSchema  bool
+	}{
+		// JSON merge patch
+		{discovery: nil, noSchema: true},
+		// Strategic merge patch
+		{discovery: fakeSchemaDiscovery{}},
+	} {
+		c := DiffCmd{
+			Client:       newFakeDynamic(live),
+			Mapper:       newFakeMapper(),
+			Discovery:    tc.discovery,
+			DiffStrategy: DiffStrategyThreeWay,
+			Context:      -1,
+		}
+
+		var buf bytes.Buffer
+		result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+		require.Equal(t, ErrModifications, err)
+		require.Equal(t, tc.noSchema, result.Objects[0].NoSchema)
+		merged := result.Objects[0].Merged
+		require.NotNil(t, merged)
+		data, _, _ := unstructured.NestedStringMap(merged.Object, "data")
+		require.Equal(t, map[string]string{"kept": "new", "server": "added-by-controller"}, data)
+
+		output := buf.String()
+		if tc.noSchema {
+			require.Contains(t, output, "NOTE: ConfigMap/ns/cm diff computed without schema")
+		} else {
+			require.NotContains(t, output, "without schema")
+		}
+		require.Contains(t, output, `-     "kept": "old",`)
+		require.Contains(t, output, `+     "kept": "new",`)
+		require.Contains(t, output, `-     "removed": "gone",`)
+		require.Contains(t, output, `      "server": "added-by-controller"`)
+		require.NotContains(t, output, AnnotationOrigObject)
+	}
+
+	// Nothing to do once config has been applied
+	applied = config.DeepCopy()
+	addOrigAnnotation(applied)
+	c := DiffCmd{
+		Client:       newFakeDynamic(applied),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: DiffStrategyThreeWay,
+	}
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+
+	// Only merging strategies have a merged object
+	c.DiffStrategy = "all"
+	result, err := c.Diff([]*unstructured.Unstructured{config}, ioutil.Discard)
+	require.NoError(t, err)
+	require.Nil(t, result.Objects[0].Merged)
+
+	// A typo mustn't quietly fall back to "all"
+	c.DiffStrategy = "3wya"
+	_, err = c.Diff([]*unstructured.Unstructured{config}, ioutil.Discard)
+	require.EqualError(t, err, `Unknown diff strategy "3wya"`)
+}
+
+func TestDiffOnlyOrigAnnotationChanged(t *testing.T) {
+	// Never updated by kubecfg, so the merge only adds the
+	// annotation
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.SetLabels(map[string]string{"mutated": "true"})
+	config := live.DeepCopy()
+
+	for _, strategy := range []string{DiffStrategyThreeWay, DiffStrategyServer} {
+		c := DiffCmd{
+			Client:       newFakeDynamic(live),
+			Mapper:       newFakeMapper(),
+			DiffStrategy: strategy,
+		}
+		var buf bytes.Buffer
+		result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+		require.NoError(t, err, strategy)
+		require.Equal(t, DiffStatusUnchanged, result.Objects[0].Status, strategy)
+		require.Contains(t, buf.String(), "ConfigMap/ns/cm unchanged\n", strategy)
+	}
+}
+
+func TestDiffServer(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{
+		"kept":    "old",
+		"removed": "gone",
+	})
+	addOrigAnnotation(live)
+	config := configMap("ns", "cm", map[string]interface{}{"kept": "new"})
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: DiffStrategyServer,
+		Context:      -1,
+	}
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+
+	output := buf.String()
+	require.Contains(t, output, `+     "kept": "new"`)
+	require.Contains(t, output, `-     "removed": "gone"`)
+	require.Contains(t, output, `+       "mutated": "true"`)
+	require.NotContains(t, output, AnnotationOrigObject)
+
+	// Nothing to dry-run against without a server
+	c.Client = nil
+	c.LiveSource = &ClusterLiveSource{Client: newFakeDynamic(live), Mapper: newFakeMapper()}
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+}
+
+func TestDiffReportConflicts(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "old"})
+	addOrigAnnotation(live)
+	client := newFakeDynamic(live)
+	client.patchErr = &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    409,
+		Reason:  metav1.StatusReasonConflict,
+		Message: "Apply failed with 1 conflict",
+		Details: &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{{
+				Type:    "FieldManagerConflict",
+				Message: `conflict with "helm"`,
+				Field:   ".data.foo",
+			}},
+		},
+	}}
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+
+	c := DiffCmd{
+		Client:       client,
+		Mapper:       newFakeMapper(),
+		DiffStrategy: DiffStrategyServer,
+	}
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+
+	c.ReportConflicts = true
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), "ConfigMap/ns/cm has conflicts:\n  .data.foo: conflict with \"helm\"\n")
+	require.Equal(t, DiffStatusChanged, result.Objects[0].Status)
+	require.Equal(t, []DiffConflict{{Field: ".data.foo", Message: `conflict with "helm"`}}, result.Objects[0].Conflicts)
+
+	// Other errors still fail
+	client.patchErr = errors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "cm", fmt.Errorf("denied"))
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+}
+
+func TestDiffEmitPatch(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "old", "gone": "x"})
+	addOrigAnnotation(live)
+	liveSecret := secret("ns", "s", map[string]interface{}{"pw": "b2xk"})
+
+	c := DiffCmd{
+		Client:      newFakeDynamic(live, liveSecret, configMap("ns", "same", nil)),
+		Mapper:      newFakeMapper(),
+		EmitPatch:   true,
+		OmitSecrets: true,
+		Context:     -1,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", nil),
+		secret("ns", "s", map[string]interface{}{"pw": "bmV3"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	output := buf.String()
+	require.Contains(t, output, "patch (merge):\n{\"data\":{\"foo\":\"new\",\"gone\":null},\"metadata\":{\"annotations\":{\""+AnnotationOrigObject+"\":")
+	require.Equal(t, 1, strings.Count(output, "patch (merge):"))
+	require.Contains(t, output, "patch: <omitted>")
+	require.NotContains(t, output, "bmV3")
+
+	// Strategic merge patch when the schema is available
+	c.Discovery = fakeSchemaDiscovery{}
+	buf.Reset()
+	_ = c.Run([]*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}, &buf)
+	require.Contains(t, buf.String(), "patch (strategic):\n")
+}
+
+func TestJSONPatch(t *testing.T) {
+	from := map[string]interface{}{
+		"a/b":  "x",
+		"gone": true,
+		"list": []interface{}{int64(1), int64(2), int64(3)},
+		"map":  map[string]interface{}{"k": "v", "n": nil},
+		"same": 1.0,
+	}
+	to := map[string]interface{}{
+		"a/b":  "y",
+		"list": []interface{}{int64(1), int64(5)},
+		"map":  map[string]interface{}{"k": "v", "n": nil, "new": []interface{}{"z"}},
+		"new~": nil,
+		"same": int64(1),
+	}
+	ops := jsonPatch([]jsonPatchOp{}, "", from, to)
+	text, err := json.Marshal(ops)
+	require.NoError(t, err)
+	require.Equal(t, `[`+
+		`{"op":"replace","path":"/a~1b","value":"y"},`+
+		`{"op":"remove","path":"/gone"},`+
+		`{"op":"replace","path":"/list/1","value":5},`+
+		`{"op":"remove","path":"/list/2"},`+
+		`{"op":"add","path":"/map/new","value":["z"]},`+
+		`{"op":"add","path":"/new~0","value":null}`+
+		`]`, string(text))
+
+	// Applying the patch gives to
+	fromJSON, err := json.Marshal(from)
+	require.NoError(t, err)
+	p, err := jsonpatch.DecodePatch(text)
+	require.NoError(t, err)
+	result, err := p.Apply(fromJSON)
+	require.NoError(t, err)
+	toJSON, err := json.Marshal(to)
+	require.NoError(t, err)
+	require.JSONEq(t, string(toJSON), string(result))
+}
+
+func TestDiffEmitJSONPatch(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "old", "gone": "x"})
+	addOrigAnnotation(live)
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		EmitPatch:    true,
+		PatchFormat:  PatchFormatJSON,
+		DiffStrategy: DiffStrategyThreeWay,
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "new"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), "patch (json):\n"+
+		`[{"op":"replace","path":"/data/foo","value":"new"},{"op":"remove","path":"/data/gone"},`)
+
+	c.PatchFormat = "bogus"
+	require.EqualError(t, c.Run(nil, &buf), `Unknown patch format "bogus"`)
+}
+
+func TestDiffFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubecfg-diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+  namespace: ns
+data:
+  foo: old
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: same
+data:
+  foo: bar
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "live.yaml"), []byte(manifest), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "more.yml"), []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: yml
+  namespace: ns
+data:
+  foo: bar
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0644))
+
+	c := DiffCmd{
+		Mapper:           newFakeMapper(),
+		DefaultNamespace: "ns",
+		FromFile:         dir,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "new", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "yml", map[string]interface{}{"foo": "bar"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	statuses := map[string]DiffStatus{}
+	for _, o := range result.Objects {
+		statuses[o.Name] = o.Status
+	}
+	require.Equal(t, map[string]DiffStatus{
+		"changed": DiffStatusChanged,
+		"same":    DiffStatusChanged, // namespace differs
+		"new":     DiffStatusCreated,
+		"yml":     DiffStatusUnchanged,
+	}, statuses)
+	require.Contains(t, buf.String(), `-     "foo": "old"`)
+}
+
+func TestDiffManifests(t *testing.T) {
+	before := []*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "removed", map[string]interface{}{"foo": "bar"}),
+	}
+	after := []*unstructured.Unstructured{
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "added", map[string]interface{}{"foo": "bar"}),
+	}
+
+	var buf bytes.Buffer
+	err := DiffManifests(before, after, DiffOptions{Quiet: true}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	output := buf.String()
+	require.Contains(t, output, `-     "foo": "old"`)
+	require.Contains(t, output, `+     "foo": "new"`)
+	require.Contains(t, output, "ConfigMap/ns/added doesn't exist on server\n@@ -0,0 +1,11 @@\n+ {\n")
+	require.Contains(t, output, "ConfigMap/ns/removed isn't in config\n@@ -1,11 +0,0 @@\n- {\n")
+	require.NotContains(t, output, "ns/same")
+
+	require.NoError(t, DiffManifests(before, before, DiffOptions{}, ioutil.Discard))
+
+	// Items of lists are matched
+	listed := []*unstructured.Unstructured{list("List", before...)}
+	require.NoError(t, DiffManifests(listed, []*unstructured.Unstructured{list("ConfigMapList", before...)}, DiffOptions{}, ioutil.Discard))
+
+	// Objects filtered out of either set aren't removed
+	labelled := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		obj.SetLabels(map[string]string{"app": "web"})
+		return obj
+	}
+	buf.Reset()
+	err = DiffManifests(
+		[]*unstructured.Unstructured{labelled(configMap("ns", "web", nil)), configMap("ns", "db", nil), configMap("ns", "gone", nil)},
+		[]*unstructured.Unstructured{labelled(configMap("ns", "web", nil)), configMap("ns", "db", nil)},
+		DiffOptions{LabelSelector: "app=web"}, &buf)
+	require.NoError(t, err)
+	require.NotContains(t, buf.String(), "isn't in config")
+}
+
+func TestDiffValidate(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "old"})
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+	config.Object["dta"] = map[string]interface{}{"bar": "baz"}
+	c := DiffCmd{
+		Client:    newFakeDynamic(live),
+		Mapper:    newFakeMapper(),
+		Discovery: fakeSchemaDiscovery{},
+		Validate:  true,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects[0].Invalid, 1)
+	require.Contains(t, result.Objects[0].Invalid[0].Error(), `unknown field "dta"`)
+	require.Contains(t, buf.String(), "WARNING: ConfigMap/ns/cm is invalid: ")
+
+	// Valid objects aren't reported
+	buf.Reset()
+	result, err = c.Diff([]*unstructured.Unstructured{configMap("ns", "cm", nil), clusterRole("r")}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Empty(t, result.Objects[0].Invalid)
+	require.NotContains(t, buf.String(), "invalid")
+
+	c.Discovery = nil
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+}
+
+func TestDiffGroupByKind(t *testing.T) {
+	c := DiffCmd{
+		Client:      newFakeDynamic(configMap("ns", "b", nil), secret("ns", "a", nil)),
+		Mapper:      newFakeMapper(),
+		GroupByKind: true,
+	}
+	config := []*unstructured.Unstructured{
+		secret("ns", "a", nil),
+		configMap("ns", "c", nil),
+		configMap("ns", "b", nil),
+		clusterRole("z"),
+	}
+
+	var buf bytes.Buffer
+	require.Equal(t, ErrCreatesOnly, c.Run(config, &buf))
+	output := buf.String()
+	headers := regexp.MustCompile("(?m)^=== .* ===$").FindAllString(output, -1)
+	require.Equal(t, []string{"=== ClusterRoles (1) ===", "=== ConfigMaps (2) ===", "=== Secrets (1) ==="}, headers)
+	require.Regexp(t, "(?s)ConfigMaps.*ns/b unchanged.*ns/c doesn't exist.*Secrets.*ns/a unchanged", output)
+
+	// Headers count, and are only for, the objects shown
+	c.Quiet = true
+	buf.Reset()
+	require.Equal(t, ErrCreatesOnly, c.Run(config, &buf))
+	headers = regexp.MustCompile("(?m)^=== .* ===$").FindAllString(buf.String(), -1)
+	require.Equal(t, []string{"=== ClusterRoles (1) ===", "=== ConfigMaps (1) ==="}, headers)
+
+	c.Quiet, c.Filter = false, DiffFilterChanged
+	buf.Reset()
+	require.Equal(t, ErrCreatesOnly, c.Run(config, &buf))
+	require.NotContains(t, buf.String(), "===")
+	c.Filter = ""
+
+	require.Equal(t, "Policies", pluralKind("Policy"))
+	require.Equal(t, "Ingresses", pluralKind("Ingress"))
+	require.Equal(t, "Endpoints", pluralKind("Endpoints"))
+	require.Equal(t, "Gateways", pluralKind("Gateway"))
+}
+
+// list returns a List-like object of the given kind holding items.
+func list(kind string, items ...*unstructured.Unstructured) *unstructured.Unstructured {
+	var objs []interface{}
+	for _, item := range items {
+		objs = append(objs, item.Object)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"items":      objs,
+	}}
+}
+
+func TestDiffLists(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "a", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "b", nil),
+		),
+		Mapper: newFakeMapper(),
 	}
+	config := list("List",
+		configMap("ns", "a", map[string]interface{}{"foo": "new"}),
+		list("ConfigMapList", configMap("ns", "b", nil), configMap("ns", "c", nil)),
+	)
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 3)
+	require.Contains(t, buf.String(), `+     "foo": "new"`)
+	require.Contains(t, buf.String(), "ConfigMap/ns/b unchanged\n")
+	require.Contains(t, buf.String(), "ConfigMap/ns/c doesn't exist on server\n")
+
+	// Items are from the list's source file
+	c.SourcePaths = map[*unstructured.Unstructured]string{config: "lists.yaml"}
+	c.OnlySourcePaths = []string{"lists.yaml"}
+	result, err = c.Diff([]*unstructured.Unstructured{config}, ioutil.Discard)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 3)
+}
+
+func TestDiffOnObject(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		),
+		Mapper: newFakeMapper(),
+		Quiet:  true,
+	}
+	seen := map[string]bool{}
+	var diffs int
+	c.OnObject = func(obj *unstructured.Unstructured, changed bool, diff []diffmatchpatch.Diff) {
+		seen[obj.GetName()] = changed
+		if diff != nil {
+			diffs++
+		}
+	}
+	config := []*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "created", nil),
+	}
+	require.Equal(t, ErrModifications, c.Run(config, ioutil.Discard))
+	require.Equal(t, map[string]bool{"changed": true, "same": false, "created": true}, seen)
+	require.Equal(t, 2, diffs)
+}
+
+func TestDiffMaxValueLen(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	live := configMap("ns", "cm", map[string]interface{}{
+		"same":    long,
+		"tail":    long + "a",
+		"short":   "old",
+		"removed": long,
+	})
+	c := DiffCmd{
+		Client:      newFakeDynamic(live),
+		Mapper:      newFakeMapper(),
+		MaxValueLen: 10,
+		Context:     -1,
+	}
+	config := configMap("ns", "cm", map[string]interface{}{
+		"same":  long,
+		"tail":  long + "b",
+		"short": "new",
+	})
+
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output := buf.String()
+	require.NotContains(t, output, long)
+	require.Contains(t, output, `      "same": "xxxxxxxxxx... (100 chars)"`)
+	require.Contains(t, output, `-     "tail": "xxxxxxxxxx... (101 chars)"`)
+	require.Contains(t, output, `+     "tail": "xxxxxxxxxx... (101 chars, changed)"`)
+	require.Contains(t, output, `-     "removed": "xxxxxxxxxx... (100 chars)"`)
+	require.Contains(t, output, `+     "short": "new"`)
+
+	// Equal long values are no difference
+	require.NoError(t, c.Run([]*unstructured.Unstructured{live.DeepCopy()}, ioutil.Discard))
+}
+
+func TestDiffDeletionPreview(t *testing.T) {
+	c := DiffCmd{
+		Client:          newFakeDynamic(configMap("ns", "live", map[string]interface{}{"foo": "old"})),
+		Mapper:          newFakeMapper(),
+		DeletionPreview: true,
+	}
+	config := []*unstructured.Unstructured{
+		configMap("ns", "live", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "missing", map[string]interface{}{"foo": "bar"}),
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff(config, &buf)
+	require.Equal(t, ErrModifications, err)
+	output := buf.String()
+	require.Contains(t, output, "ConfigMap/ns/live would be deleted\n@@ -1,11 +0,0 @@\n- {\n")
+	require.Contains(t, output, `-     "foo": "old"`)
+	require.NotContains(t, output, `"new"`)
+	require.Contains(t, output, "ConfigMap/ns/missing doesn't exist on server, nothing to delete\n")
+	require.Equal(t, DiffStatusOrphaned, result.Objects[0].Status)
+	require.Equal(t, 11, result.Objects[0].Removed)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+
+	require.NoError(t, c.Run(config[1:], ioutil.Discard))
+
+	c.Against = AgainstPreviousAnnotation
+	require.Error(t, c.Run(config, ioutil.Discard))
+}
+
+func TestDiffIgnoreWhitespace(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{
+			"nginx.conf": "server {\n  listen 80;\n}\n",
+			"motd":       "hello world",
+		})),
+		Mapper:           newFakeMapper(),
+		IgnoreWhitespace: true,
+	}
+	config := configMap("ns", "cm", map[string]interface{}{
+		"nginx.conf": "server {\n\tlisten  80; \n}",
+		"motd":       "hello world  ",
+	})
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+
+	config.Object["data"].(map[string]interface{})["nginx.conf"] = "server {\n  listen 8080;\n}\n"
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), `+     "nginx.conf": "server {\nlisten 8080;\n}"`)
+
+	c.IgnoreWhitespace = false
+	config = configMap("ns", "cm", map[string]interface{}{
+		"nginx.conf": "server {\n  listen 80;\n}\n",
+		"motd":       "hello world  ",
+	})
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+}
+
+func TestDiffSuppressLines(t *testing.T) {
+	withTimestamp := func(obj *unstructured.Unstructured, ts string) *unstructured.Unstructured {
+		obj.SetAnnotations(map[string]string{"example.com/restarted-at": ts})
+		return obj
+	}
+	c := DiffCmd{
+		Client: newFakeDynamic(withTimestamp(configMap("ns", "cm", map[string]interface{}{"foo": "old"}), "2020-01-02")),
+		Mapper: newFakeMapper(),
+		SuppressLines: []*regexp.Regexp{
+			regexp.MustCompile(`"example\.com/restarted-at"`),
+		},
+		Context: -1,
+	}
+
+	// Only suppressed changes
+	result, err := c.Diff([]*unstructured.Unstructured{
+		withTimestamp(configMap("ns", "cm", map[string]interface{}{"foo": "old"}), "2020-01-01"),
+	}, ioutil.Discard)
+	require.NoError(t, err)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[0].Status)
+
+	var buf bytes.Buffer
+	result, err = c.Diff([]*unstructured.Unstructured{
+		withTimestamp(configMap("ns", "cm", map[string]interface{}{"foo": "new"}), "2020-01-01"),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, 1, result.Objects[0].Added)
+	require.Equal(t, 1, result.Objects[0].Removed)
+	output := buf.String()
+	require.Contains(t, output, "\n        \"example.com/restarted-at\": \"2020-01-02\"\n")
+	require.NotContains(t, output, "2020-01-01")
+	require.Contains(t, output, `+     "foo": "new"`)
+}
+
+func TestDiffObjects(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar", "extra": "x"})
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+
+	diffs, err := DiffObjects(live, config, "all", nil)
+	require.NoError(t, err)
+	require.False(t, isEmptyDiff(diffs))
+	require.Equal(t, []diffmatchpatch.Diff{{Type: diffmatchpatch.DiffDelete, Text: "    \"extra\": \"x\",\n"}}, diffs[1:2])
+
+	diffs, err = DiffObjects(live, config, "subset", nil)
+	require.NoError(t, err)
+	require.True(t, isEmptyDiff(diffs))
+}
+
+// slowLiveSource wraps a LiveSource, delaying each Get so that
+// parallel fetches complete out of order.
+type slowLiveSource struct {
+	LiveSource
+	mu              sync.Mutex
+	active, maxSeen int
+	fail            string
+}
+
+func (s *slowLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxSeen {
+		s.maxSeen = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	// Later objects finish first
+	time.Sleep(time.Duration(10-len(obj.GetName())) * 2 * time.Millisecond)
+	if obj.GetName() == s.fail {
+		return nil, fmt.Errorf("injected failure")
+	}
+	return s.LiveSource.Get(obj)
+}
+
+func TestDiffConcurrency(t *testing.T) {
+	var live, config []*unstructured.Unstructured
+	for i := 0; i < 8; i++ {
+		name := strings.Repeat("x", i+1)
+		live = append(live, configMap("ns", name, map[string]interface{}{"foo": "old"}))
+		config = append(config, configMap("ns", name, map[string]interface{}{"foo": "new"}))
+	}
+	source := &ClusterLiveSource{Client: newFakeDynamic(live...), Mapper: newFakeMapper()}
+
+	var sequential bytes.Buffer
+	c := DiffCmd{Mapper: newFakeMapper(), LiveSource: &slowLiveSource{LiveSource: source}}
+	require.Equal(t, ErrModifications, c.Run(config, &sequential))
+
+	slow := &slowLiveSource{LiveSource: source}
+	c.LiveSource = slow
+	c.Concurrency = 4
+	var parallel bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run(config, &parallel))
+	require.Equal(t, sequential.String(), parallel.String())
+	require.True(t, slow.maxSeen > 1, "fetches should overlap")
+	require.True(t, slow.maxSeen <= 4, "at most Concurrency fetches at once")
+
+	var progress []int
+	c.OnProgress = func(done, total int) {
+		require.Equal(t, len(config), total)
+		progress = append(progress, done)
+	}
+	require.Equal(t, ErrModifications, c.Run(config, ioutil.Discard))
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8}, progress)
+	c.OnProgress = nil
+
+	c.LiveSource = &slowLiveSource{LiveSource: source, fail: "xxx"}
+	var failed bytes.Buffer
+	err := c.Run(config, &failed)
+	require.EqualError(t, err, "Error fetching ConfigMap/ns/xxx: injected failure")
+	require.Empty(t, failed.String())
+}
+
+func TestDiffStableOrdering(t *testing.T) {
+	obj := deployment("ns", "web", int64(3))
+	obj.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5"},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "x", "image": "x:1", "args": []interface{}{"-a", "-b"}},
+				map[string]interface{}{"name": "y", "image": "y:1", "env": map[string]interface{}{"k1": "v1", "k2": "v2"}},
+			},
+		},
+	}
+
+	for _, strategy := range []string{"all", "subset"} {
+		for _, serialization := range []string{"json", "yaml"} {
+			c := DiffCmd{
+				Client:        newFakeDynamic(obj),
+				Mapper:        newFakeMapper(),
+				DiffStrategy:  strategy,
+				Serialization: serialization,
+			}
+			// Map iteration order is randomised, so repeat
+			for i := 0; i < 100; i++ {
+				var buf bytes.Buffer
+				require.NoError(t, c.Run([]*unstructured.Unstructured{obj.DeepCopy()}, &buf))
+				require.Contains(t, buf.String(), "Deployment/ns/web unchanged")
+			}
+		}
+	}
+}
+
+func TestParseFieldPath(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected []string
+	}{
+		{path: "status", expected: []string{"status"}},
+		{path: "metadata.annotations.foo", expected: []string{"metadata", "annotations", "foo"}},
+		{path: `metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`, expected: []string{"metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration"}},
+		{path: `['a.b'].c`, expected: []string{"a.b", "c"}},
+	} {
+		fields, err := parseFieldPath(tc.path)
+		require.NoError(t, err, tc.path)
+		require.Equal(t, tc.expected, fields, tc.path)
+	}
+
+	for _, path := range []string{"", ".", `a["b`, "a..b", "a[0]"} {
+		_, err := parseFieldPath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestDiffIncludeStatus(t *testing.T) {
+	live := deployment("ns", "web", int64(1))
+	live.Object["status"] = map[string]interface{}{"readyReplicas": int64(1)}
+	c := DiffCmd{
+		Client:  newFakeDynamic(live),
+		Mapper:  newFakeMapper(),
+		Context: -1,
+	}
+	config := []*unstructured.Unstructured{deployment("ns", "web", int64(1))}
+
+	var buf bytes.Buffer
+	require.NoError(t, c.Run(config, &buf))
+	require.NotContains(t, buf.String(), "readyReplicas")
+
+	c.IncludeStatus = true
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run(config, &buf))
+	require.Contains(t, buf.String(), `-     "readyReplicas": 1`)
+}
+
+func TestDiffIgnorePaths(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.Object["status"] = map[string]interface{}{"phase": "Ready"}
+	utils.SetMetaDataAnnotation(live, "kubectl.kubernetes.io/last-applied-configuration", "{}")
+	utils.SetMetaDataAnnotation(live, "keep", "me")
+	live.Object["items"] = []interface{}{
+		map[string]interface{}{"name": "a", "generated": "x"},
+		map[string]interface{}{"name": "b", "generated": "y"},
+	}
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	utils.SetMetaDataAnnotation(config, "keep", "me")
+	config.Object["items"] = []interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b"},
+	}
+
+	c := DiffCmd{
+		Client: newFakeDynamic(live),
+		Mapper: newFakeMapper(),
+		IgnorePaths: []string{
+			"status",
+			`metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`,
+			"items.generated",
+		},
+	}
+	for _, strategy := range []string{"all", "subset"} {
+		c.DiffStrategy = strategy
+		var buf bytes.Buffer
+		require.NoError(t, c.Run([]*unstructured.Unstructured{config}, &buf), strategy)
+	}
+
+	// Live object itself is untouched
+	require.Contains(t, live.Object, "status")
+	require.Contains(t, live.GetAnnotations(), "kubectl.kubernetes.io/last-applied-configuration")
+
+	c.IgnorePaths = []string{`metadata["oops`}
+	var buf bytes.Buffer
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+}
+
+func TestNormalizeNumbers(t *testing.T) {
+	for _, v := range []interface{}{
+		3, int32(3), int64(3), uint8(3), uint64(3), float32(3), float64(3), json.Number("3"), json.Number("3.0"),
+	} {
+		require.Equal(t, int64(3), normalizeNumbers(v), "%T", v)
+	}
+	require.Equal(t, 0.1, normalizeNumbers(float32(0.1)))
+	require.Equal(t, 2.5, normalizeNumbers(json.Number("2.5")))
+	require.Equal(t, "3", normalizeNumbers("3"))
+
+	in := map[string]interface{}{"a": []interface{}{float64(1)}}
+	require.Equal(t, map[string]interface{}{"a": []interface{}{int64(1)}}, normalizeNumbers(in))
+	// Input is unchanged
+	require.Equal(t, float64(1), in["a"].([]interface{})[0])
+}
+
+func TestDiffRawExtension(t *testing.T) {
+	workflow := func(template interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Workflow",
+				"metadata": map[string]interface{}{
+					"name":      "wf",
+					"namespace": "ns",
+				},
+				"spec": map[string]interface{}{
+					"template": template,
+				},
+			},
+		}
+	}
+	live := workflow(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "wf"}},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"image": "app:1", "name": "app", "ports": []interface{}{int64(80)}},
+			},
+		},
+	})
+
+	for _, template := range []interface{}{
+		runtime.RawExtension{Raw: []byte(`{"spec": {"containers": [{"name": "app", "ports": [80.0], "image": "app:1"}]},
+			"metadata": {"labels": {"app": "wf"}}}`)},
+		&runtime.RawExtension{Object: &unstructured.Unstructured{Object: live.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})}},
+		json.RawMessage(`{"metadata":{"labels":{"app":"wf"}},"spec":{"containers":[{"ports":[80],"name":"app","image":"app:1"}]}}`),
+	} {
+		diffs, err := DiffObjects(live, workflow(template), "", nil)
+		require.NoError(t, err)
+		require.True(t, isEmptyDiff(diffs), "%T: %s", template, DiffCmd{Context: -1}.formatDiff(diffs, false))
+	}
+
+	diffs, err := DiffObjects(live, workflow(runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"app:2"}]}}`)}), "", nil)
+	require.NoError(t, err)
+	require.Contains(t, DiffCmd{Context: -1}.formatDiff(diffs, false), `+             "image": "app:2",`)
+}
+
+func deployment(ns, name string, replicas interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": ns,
+			},
+			"spec": map[string]interface{}{
+				"replicas": replicas,
+			},
+		},
+	}
+}
+
+func TestDiffNumbers(t *testing.T) {
+	// eg: decoded with json.Decoder.UseNumber
+	live := deployment("ns", "d", json.Number("3.0"))
+	text, err := json.Marshal(live.Object)
+	require.NoError(t, err)
+	require.Contains(t, string(text), `"replicas":3.0`)
+
+	c := DiffCmd{
+		Client: newFakeDynamic(live),
+		Mapper: newFakeMapper(),
+	}
+	var buf bytes.Buffer
+	err = c.Run([]*unstructured.Unstructured{deployment("ns", "d", 3)}, &buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "unchanged")
+}
+
+func TestDiffErrorOnDiff(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+	}
+	config := []*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}
+
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run(config, &buf))
+
+	errorOnDiff := true
+	c.ErrorOnDiff = &errorOnDiff
+	require.Equal(t, ErrModifications, c.Run(config, &buf))
+
+	errorOnDiff = false
+	result, err := c.Diff(config, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Count(DiffStatusChanged))
+}
+
+func TestDiffFoundErrors(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+	}
+	created := configMap("ns", "new", nil)
+	changed := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{created}, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.True(t, goerrors.Is(err, ErrDiffFound))
+	require.False(t, goerrors.Is(err, ErrModifications))
+
+	err = c.Run([]*unstructured.Unstructured{created, changed}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.True(t, goerrors.Is(err, ErrDiffFound))
+	require.False(t, goerrors.Is(fmt.Errorf("other"), ErrDiffFound))
+}
+
+func clusterRole(name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "ClusterRole",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"rules": []interface{}{},
+		},
+	}
+}
+
+func TestDiffDescribe(t *testing.T) {
+	c := DiffCmd{
+		Client:           newFakeDynamic(clusterRole("admin"), deployment("ns", "web", int64(1))),
+		Mapper:           newFakeMapper(),
+		DefaultNamespace: "default",
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		clusterRole("admin"),
+		deployment("ns", "web", int64(1)),
+	}, &buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "- live ClusterRole/admin\n+ config ClusterRole/admin\nClusterRole/admin unchanged\n")
+	require.Contains(t, buf.String(), "- live Deployment/ns/web\n+ config Deployment/ns/web\nDeployment/ns/web unchanged\n")
+
+	// Cluster-scoped objects ignore DefaultNamespace
+	require.Equal(t, "ClusterRole/admin", c.describe(clusterRole("admin")))
+	require.Equal(t, "Deployment/default/web", c.describe(deployment("", "web", int64(1))))
+
+	// Unknown kinds fall back on the object's own namespace
+	unknown := deployment("", "thing", int64(1))
+	unknown.SetKind("Unknown")
+	require.Equal(t, "Unknown/thing", c.describe(unknown))
+}
+
+func TestDiffDefaultNamespace(t *testing.T) {
+	c := DiffCmd{
+		Client:           newFakeDynamic(configMap("staging", "cm", map[string]interface{}{"foo": "bar"})),
+		Mapper:           newFakeMapper(),
+		DefaultNamespace: "staging",
+		Context:          -1,
+	}
+
+	var buf bytes.Buffer
+	_, err := c.Diff([]*unstructured.Unstructured{configMap("", "cm", map[string]interface{}{"foo": "bar"})}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	// Header shows the namespace the object was fetched from
+	output := buf.String()
+	require.Contains(t, output, "- live ConfigMap/staging/cm\n+ config ConfigMap/staging/cm\n")
+	require.NotContains(t, output, "doesn't exist")
+	require.NotContains(t, output, "ConfigMap/cm")
+}
+
+func TestDiffYAML(t *testing.T) {
+	c := DiffCmd{
+		Client:        newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old", "bar": "same"})),
+		Mapper:        newFakeMapper(),
+		Context:       -1,
+		Serialization: "yaml",
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new", "bar": "same"})}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), "  apiVersion: v1\n  data:\n    bar: same\n-   foo: old\n+   foo: new\n  kind: ConfigMap\n")
+
+	c.Serialization = "xml"
+	require.Error(t, c.Run(nil, &buf))
+}
+
+// fakeSchemaDiscovery serves the OpenAPI schema from testdata.  All
+// other discovery methods are unimplemented.
+type fakeSchemaDiscovery struct {
+	discovery.DiscoveryInterface
+}
+
+func (fakeSchemaDiscovery) OpenAPISchema() (*openapi_v2.Document, error) {
+	var doc openapi_v2.Document
+	b, err := ioutil.ReadFile(filepath.FromSlash("../../testdata/schema.pb"))
+	if err != nil {
+		return nil, err
+	}
+	if err := pb_proto.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// countingDiscovery is a fakeSchemaDiscovery that counts schema
+// fetches
+type countingDiscovery struct {
+	fakeSchemaDiscovery
+	version string
+	fetches int
+}
+
+func (d *countingDiscovery) OpenAPISchema() (*openapi_v2.Document, error) {
+	d.fetches++
+	return d.fakeSchemaDiscovery.OpenAPISchema()
+}
+
+func (d *countingDiscovery) ServerVersion() (*version.Info, error) {
+	return &version.Info{GitVersion: d.version}, nil
+}
+
+func TestDiffSchemaCache(t *testing.T) {
+	disco := &countingDiscovery{version: "v1.15.0"}
+	cache := &MemorySchemaCache{}
+	c := DiffCmd{
+		Client:       newFakeDynamic(),
+		Mapper:       newFakeMapper(),
+		Discovery:    disco,
+		DiffStrategy: "subset",
+		SchemaCache:  cache,
+	}
+	objs := []*unstructured.Unstructured{configMap("ns", "cm", nil)}
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, ErrCreatesOnly, c.Run(objs, ioutil.Discard))
+	}
+	require.Equal(t, 1, disco.fetches)
+	require.NotNil(t, cache.Get("v1.15.0"))
+
+	// New server version means a new schema
+	disco.version = "v1.16.0"
+	require.Equal(t, ErrCreatesOnly, c.Run(objs, ioutil.Discard))
+	require.Equal(t, 2, disco.fetches)
+
+	c.SchemaCache = nil
+	require.Equal(t, ErrCreatesOnly, c.Run(objs, ioutil.Discard))
+	require.Equal(t, 3, disco.fetches)
+}
+
+// countingDiffCache is a MemoryDiffCache that counts hits
+type countingDiffCache struct {
+	MemoryDiffCache
+	hits int
+}
+
+func (m *countingDiffCache) Get(key string) ([]diffmatchpatch.Diff, bool) {
+	diff, ok := m.MemoryDiffCache.Get(key)
+	if ok {
+		m.hits++
+	}
+	return diff, ok
+}
+
+func TestDiffCache(t *testing.T) {
+	withVersion := func(obj *unstructured.Unstructured, rv string) *unstructured.Unstructured {
+		obj.SetResourceVersion(rv)
+		return obj
+	}
+	cache := &countingDiffCache{}
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			withVersion(configMap("ns", "a", map[string]interface{}{"foo": "old"}), "1"),
+			withVersion(configMap("ns", "b", map[string]interface{}{"foo": "bar"}), "1"),
+			configMap("ns", "unversioned", nil),
+		),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: "subset",
+		Cache:        cache,
+	}
+	objs := []*unstructured.Unstructured{
+		configMap("ns", "a", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "b", map[string]interface{}{"foo": "bar"}),
+		configMap("ns", "unversioned", nil),
+	}
+
+	var first, second bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run(objs, &first))
+	require.Equal(t, 0, cache.hits)
+	require.Equal(t, ErrModifications, c.Run(objs, &second))
+	require.Equal(t, 2, cache.hits)
+	require.Equal(t, first.String(), second.String())
+
+	// Changed config
+	objs[1] = configMap("ns", "b", map[string]interface{}{"foo": "baz"})
+	require.Equal(t, ErrModifications, c.Run(objs, ioutil.Discard))
+	require.Equal(t, 3, cache.hits)
+
+	// Changed live object
+	c.Client = newFakeDynamic(
+		withVersion(configMap("ns", "a", map[string]interface{}{"foo": "new"}), "2"),
+		withVersion(configMap("ns", "b", map[string]interface{}{"foo": "bar"}), "1"),
+	)
+	result, err := c.Diff(objs[:2], ioutil.Discard)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, 4, cache.hits)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[0].Status)
+	require.Equal(t, DiffStatusChanged, result.Objects[1].Status)
+}
+
+func TestDiffSubsetMergeKeys(t *testing.T) {
+	withContainers := func(obj *unstructured.Unstructured, containers ...interface{}) *unstructured.Unstructured {
+		obj.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+			"spec": map[string]interface{}{"containers": containers},
+		}
+		return obj
+	}
+	live := withContainers(deployment("ns", "web", int64(1)),
+		map[string]interface{}{"name": "app", "image": "app:1", "imagePullPolicy": "IfNotPresent"},
+	)
+	config := withContainers(deployment("ns", "web", int64(1)),
+		map[string]interface{}{"name": "sidecar", "image": "proxy:1", "imagePullPolicy": "Always"},
+		map[string]interface{}{"name": "app", "image": "app:1"},
+	)
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		Discovery:    fakeSchemaDiscovery{},
+		DiffStrategy: "subset",
+		Context:      -1,
+	}
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+
+	// The app container is compared with app, not sidecar
+	output := buf.String()
+	require.NotContains(t, output, "IfNotPresent")
+	require.Contains(t, output, `+             "name": "sidecar"`)
+	require.NotContains(t, output, `-             "name": "app"`)
+
+	// Without a schema, list elements are compared by position
+	c.Discovery = nil
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), "IfNotPresent")
+}
+
+func TestDiffSubsetInitContainers(t *testing.T) {
+	withInitContainers := func(obj *unstructured.Unstructured, containers ...interface{}) *unstructured.Unstructured {
+		obj.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+			"spec": map[string]interface{}{"initContainers": containers},
+		}
+		return obj
+	}
+	migrate := map[string]interface{}{"name": "migrate", "image": "app:1"}
+	warm := map[string]interface{}{"name": "warm", "image": "cache:1"}
+	live := withInitContainers(deployment("ns", "web", int64(1)),
+		map[string]interface{}{"name": "migrate", "image": "app:1", "imagePullPolicy": "IfNotPresent"},
+		map[string]interface{}{"name": "warm", "image": "cache:1", "imagePullPolicy": "IfNotPresent"},
+	)
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		Discovery:    fakeSchemaDiscovery{},
+		DiffStrategy: "subset",
+		Context:      -1,
+	}
+
+	// Reordered in config only
+	config := withInitContainers(deployment("ns", "web", int64(1)), warm, migrate)
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard))
+
+	// Only the changed image is shown, against the right container
+	config = withInitContainers(deployment("ns", "web", int64(1)),
+		warm,
+		map[string]interface{}{"name": "migrate", "image": "app:2"},
+	)
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output := buf.String()
+	require.Contains(t, output, `-             "image": "app:1",`)
+	require.Contains(t, output, `+             "image": "app:2",`)
+	require.Equal(t, 1, strings.Count(output, "\n-  "))
+	require.Equal(t, 1, strings.Count(output, "\n+  "))
+
+	// Extra live fields are restored to the reordered elements
+	c.ShowExtraLiveFields = true
+	config = withInitContainers(deployment("ns", "web", int64(1)), warm, migrate)
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output = buf.String()
+	require.Contains(t, output, `              "image": "cache:1",
+-             "imagePullPolicy": "IfNotPresent",
+              "name": "warm"`)
+	require.Equal(t, 2, strings.Count(output, "\n-  "))
+	require.NotContains(t, output, "\n+  ")
+}
+
+func TestJSONLinePaths(t *testing.T) {
+	text, err := marshalIndent(map[string]interface{}{
+		"a.b": map[string]interface{}{},
+		"list": []interface{}{
+			"x",
+			map[string]interface{}{"name": "y"},
+			[]interface{}{},
+		},
+		"map": map[string]interface{}{"k": "v"},
+	}, "  ")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"",
+		"a.b",
+		"list",
+		"list[0]",
+		"list[1]",
+		"list[1].name",
+		"list[1]",
+		"list[2]",
+		"list",
+		"map",
+		"map.k",
+		"map",
+		"",
+	}, jsonLinePaths(string(text)))
+}
+
+func TestFormatDiffHunkPaths(t *testing.T) {
+	live := withContainer(deployment("ns", "web", int64(3)), "app:1")
+	config := withContainer(deployment("ns", "web", int64(4)), "app:2")
+	diffs, err := DiffObjects(live, config, "", nil)
+	require.NoError(t, err)
+
+	c := DiffCmd{Context: 0, HunkPaths: true}
+	require.Equal(t, "@@ -9,1 +9,1 @@ spec.replicas\n"+
+		"-     \"replicas\": 3,\n"+
+		"+     \"replicas\": 4,\n"+
+		"@@ -14,1 +14,1 @@ spec.template.spec.containers[0].image\n"+
+		"-             \"image\": \"app:1\",\n"+
+		"+             \"image\": \"app:2\",", c.formatDiff(diffs, false))
+
+	c.Context = -1
+	text := c.formatDiff(diffs, false)
+	require.Contains(t, text, "\n@@ spec.replicas @@\n-     \"replicas\": 3,\n")
+	require.Contains(t, text, "\n@@ spec.template.spec.containers[0].image @@\n-             \"image\": \"app:1\",\n")
+	require.True(t, strings.HasPrefix(text, "  {\n"))
+	require.True(t, strings.HasSuffix(text, "\n  }"))
+}
+
+func withContainer(obj *unstructured.Unstructured, image string) *unstructured.Unstructured {
+	obj.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "app", "image": image},
+			},
+		},
+	}
+	return obj
+}
+
+func TestDiffShowManagers(t *testing.T) {
+	withManagedFields := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		obj.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+			"spec": map[string]interface{}{
+				"containers": []interface{}{
+					map[string]interface{}{"name": "app", "image": "app:1"},
+				},
+			},
+		}
+		return obj
+	}
+	live := withManagedFields(deployment("ns", "web", int64(3)))
+	live.Object["metadata"].(map[string]interface{})["managedFields"] = []interface{}{
+		map[string]interface{}{
+			"manager":    "hpa",
+			"operation":  "Update",
+			"fieldsType": "FieldsV1",
+			"fieldsV1": map[string]interface{}{
+				"f:spec": map[string]interface{}{"f:replicas": map[string]interface{}{}},
+			},
+		},
+		map[string]interface{}{
+			"manager":    "kubecfg",
+			"operation":  "Update",
+			"fieldsType": "FieldsV1",
+			"fieldsV1": map[string]interface{}{
+				"f:spec": map[string]interface{}{
+					"f:template": map[string]interface{}{
+						"f:spec": map[string]interface{}{
+							"f:containers": map[string]interface{}{
+								`k:{"name":"app"}`: map[string]interface{}{
+									".":       map[string]interface{}{},
+									"f:image": map[string]interface{}{},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	config := withManagedFields(deployment("ns", "web", int64(5)))
+	config.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})["image"] = "app:2"
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: "subset",
+		ShowManagers: true,
+		Context:      -1,
+	}
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+
+	output := buf.String()
+	require.Contains(t, output, `-     "replicas": 3,  (manager: hpa)`)
+	require.Contains(t, output, `+     "replicas": 5,  (manager: hpa)`)
+	require.Contains(t, output, `-             "image": "app:1",  (manager: kubecfg)`)
+	require.Contains(t, output, `+             "image": "app:2",  (manager: kubecfg)`)
+
+	c.ShowManagers = false
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.NotContains(t, buf.String(), "manager:")
+}
+
+func TestDiffShowManagersSuppressLines(t *testing.T) {
+	managed := func(manager, field string) interface{} {
+		return map[string]interface{}{
+			"manager":    manager,
+			"operation":  "Update",
+			"fieldsType": "FieldsV1",
+			"fieldsV1": map[string]interface{}{
+				"f:data": map[string]interface{}{"f:" + field: map[string]interface{}{}},
+			},
+		}
+	}
+	live := configMap("ns", "cm", map[string]interface{}{"a": "x", "b": "old", "c": "old"})
+	live.Object["metadata"].(map[string]interface{})["managedFields"] = []interface{}{
+		managed("alice", "a"), managed("bob", "b"), managed("carol", "c"),
+	}
+	c := DiffCmd{
+		Client:        newFakeDynamic(live),
+		Mapper:        newFakeMapper(),
+		ShowManagers:  true,
+		SuppressLines: []*regexp.Regexp{regexp.MustCompile(`"a": "x",$`)},
+		Context:       -1,
+	}
+	config := configMap("ns", "cm", map[string]interface{}{"b": "new", "c": "new"})
+
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	output := buf.String()
+	require.Contains(t, output, "\n      \"a\": \"x\",\n")
+	require.Contains(t, output, `-     "b": "old",  (manager: bob)`)
+	require.Contains(t, output, `+     "b": "new",  (manager: bob)`)
+	require.Contains(t, output, `-     "c": "old"  (manager: carol)`)
+	require.Contains(t, output, `+     "c": "new"  (manager: carol)`)
+}
+
+func TestDiffIgnoreServerDefaults(t *testing.T) {
+	podSpec := func(extra map[string]interface{}) map[string]interface{} {
+		spec := map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "c", "image": "nginx"},
+			},
+		}
+		for k, v := range extra {
+			spec[k] = v
+		}
+		return spec
+	}
+	live := deployment("ns", "web", int64(1))
+	live.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"spec": podSpec(map[string]interface{}{
+			"dnsPolicy":                     "ClusterFirst",
+			"restartPolicy":                 "Always",
+			"terminationGracePeriodSeconds": int64(30),
+			"schedulerName":                 "custom",
+		}),
+	}
+	live.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})["terminationMessagePath"] = "/dev/termination-log"
+
+	config := deployment("ns", "web", int64(1))
+	config.Object["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"spec": podSpec(map[string]interface{}{"restartPolicy": "Always"}),
+	}
+
+	c := DiffCmd{
+		Client:               newFakeDynamic(live),
+		Mapper:               newFakeMapper(),
+		Discovery:            fakeSchemaDiscovery{},
+		Context:              -1,
+		IgnoreServerDefaults: true,
+	}
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+
+	output := buf.String()
+	require.NotContains(t, output, "dnsPolicy")
+	require.NotContains(t, output, "terminationGracePeriodSeconds")
+	require.NotContains(t, output, "terminationMessagePath")
+	// restartPolicy is in config, so kept
+	require.Contains(t, output, `"restartPolicy": "Always"`)
+	// Not the default
+	require.Contains(t, output, `-         "schedulerName": "custom"`)
+
+	// No schema to get defaults from
+	c.Discovery = nil
+	require.EqualError(t, c.Run([]*unstructured.Unstructured{config}, ioutil.Discard), "Ignoring server defaults requires a server")
+}
+
+func TestDiffContinueOnError(t *testing.T) {
+	source := &ClusterLiveSource{
+		Client: newFakeDynamic(
+			configMap("ns", "a", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "c", map[string]interface{}{"foo": "old"}),
+		),
+		Mapper: newFakeMapper(),
+	}
+	config := []*unstructured.Unstructured{
+		configMap("ns", "a", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "bbb", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "c", map[string]interface{}{"foo": "new"}),
+	}
+
+	c := DiffCmd{
+		Mapper:          newFakeMapper(),
+		LiveSource:      &slowLiveSource{LiveSource: source, fail: "bbb"},
+		ContinueOnError: true,
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff(config, &buf)
+	require.EqualError(t, err, "Error fetching ConfigMap/ns/bbb: injected failure")
+	require.Contains(t, buf.String(), "+ config ConfigMap/ns/bbb\nWARNING: Error fetching ConfigMap/ns/bbb: injected failure\n")
+
+	require.Len(t, result.Objects, 3)
+	require.Equal(t, DiffStatusChanged, result.Objects[0].Status)
+	require.Equal(t, DiffStatusError, result.Objects[1].Status)
+	require.EqualError(t, result.Objects[1].Error, "Error fetching ConfigMap/ns/bbb: injected failure")
+	require.Equal(t, DiffStatusChanged, result.Objects[2].Status)
+}
+
+func TestDiffColor(t *testing.T) {
+	c := DiffCmd{
+		Client:  newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper:  newFakeMapper(),
+		Context: -1,
+	}
+	config := []*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}
+
+	for _, tc := range []struct {
+		color    string
+		expected bool
+	}{
+		// A bytes.Buffer is not a terminal
+		{color: "", expected: false},
+		{color: DiffColorAuto, expected: false},
+		{color: DiffColorAlways, expected: true},
+		{color: DiffColorNever, expected: false},
+	} {
+		c.Color = tc.color
+		var buf bytes.Buffer
+		require.Equal(t, ErrModifications, c.Run(config, &buf))
+		require.Equal(t, tc.expected, strings.Contains(buf.String(), "\x1b["), "color %q", tc.color)
+	}
+
+	c.Color = "sometimes"
+	require.Error(t, c.Run(config, ioutil.Discard))
+}
+
+func TestDiffColorFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "kubecfg-diff")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Colors depend on out, not os.Stdout
+	c := DiffCmd{
+		Client:  newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper:  newFakeMapper(),
+		Context: -1,
+	}
+	err = c.Run([]*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}, f)
+	require.Equal(t, ErrModifications, err)
+
+	text, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Contains(t, string(text), `+     "foo": "new"`)
+	require.NotContains(t, string(text), "\x1b[")
+}
+
+func TestUseColorNoColor(t *testing.T) {
+	old, wasSet := os.LookupEnv("NO_COLOR")
+	defer func() {
+		if wasSet {
+			os.Setenv("NO_COLOR", old)
+		} else {
+			os.Unsetenv("NO_COLOR")
+		}
+	}()
+
+	os.Setenv("NO_COLOR", "")
+	require.False(t, DiffCmd{}.useColor(os.Stdout))
+	require.True(t, DiffCmd{Color: DiffColorAlways}.useColor(os.Stdout))
+}
+
+func TestUseColorForceTTY(t *testing.T) {
+	old, wasSet := os.LookupEnv("NO_COLOR")
+	defer func() {
+		if wasSet {
+			os.Setenv("NO_COLOR", old)
+		}
+	}()
+	os.Unsetenv("NO_COLOR")
+
+	yes, no := true, false
+	var buf bytes.Buffer
+	require.False(t, DiffCmd{}.useColor(&buf))
+	require.True(t, DiffCmd{ForceTTY: &yes}.useColor(&buf))
+	require.False(t, DiffCmd{ForceTTY: &no}.useColor(os.Stdout))
+	require.False(t, DiffCmd{ForceTTY: &yes, Color: DiffColorNever}.useColor(&buf))
+
+	c := DiffCmd{
+		Client:   newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper:   newFakeMapper(),
+		ForceTTY: &yes,
+	}
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), "\x1b[")
+}
+
+func TestDiffHTML(t *testing.T) {
+	c := DiffCmd{
+		Client:  newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "<old>"})),
+		Mapper:  newFakeMapper(),
+		Format:  DiffFormatHTML,
+		Color:   DiffColorAlways,
+		Context: -1,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "a & b"}),
+		configMap("ns", "new", nil),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+
+	output := buf.String()
+	require.Equal(t, 2, strings.Count(output, "<pre class=\"diff\">\n---\n"))
+	require.Equal(t, 2, strings.Count(output, "</pre>\n"))
+	require.Contains(t, output, `<span class="diff-del">-     "foo": "&lt;old&gt;"`+"\n</span>")
+	require.Contains(t, output, `<span class="diff-add">+     "foo": "a &amp; b"`+"\n</span>")
+	require.Contains(t, output, "ConfigMap/ns/new doesn't exist on server\n</pre>\n")
+	require.NotContains(t, output, "\x1b[")
+
+	c.Granularity = DiffGranularityWord
+	buf.Reset()
+	_ = c.Run([]*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "<new>"})}, &buf)
+	require.Contains(t, buf.String(), `<span class="diff-del">-     "foo": "&lt;<mark>old</mark>&gt;"</span>`)
+
+	c.Format = "pdf"
+	require.Error(t, c.Run(nil, &buf))
+}
+
+func TestDiffStat(t *testing.T) {
+	require.Equal(t, 0, func() int { a, r := diffStat(nil); return a + r }())
+	added, removed := diffStat([]diffmatchpatch.Diff{
+		{Type: diffmatchpatch.DiffEqual, Text: "{\n"},
+		{Type: diffmatchpatch.DiffDelete, Text: "a\nb\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "c\n"},
+		{Type: diffmatchpatch.DiffEqual, Text: "d\n"},
+		{Type: diffmatchpatch.DiffInsert, Text: "}"},
+	})
+	require.Equal(t, 2, added)
+	require.Equal(t, 2, removed)
+
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "cm", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", nil),
+		),
+		Mapper: newFakeMapper(),
+		Stat:   true,
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "new", "bar": "baz"}),
+		configMap("ns", "new", nil),
+		configMap("ns", "same", nil),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, "ConfigMap/ns/cm changed, +2 -1\n"+
+		"ConfigMap/ns/new doesn't exist on server\n"+
+		"ConfigMap/ns/same unchanged\n", buf.String())
+	require.Equal(t, 2, result.Objects[0].Added)
+	require.Equal(t, 1, result.Objects[0].Removed)
+}
+
+func TestDiffMaxObjectBytes(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "big", map[string]interface{}{"file": strings.Repeat("a", 300)}),
+			configMap("ns", "same", map[string]interface{}{"file": strings.Repeat("a", 300)}),
+			configMap("ns", "small", map[string]interface{}{"foo": "old"}),
+		),
+		Mapper:         newFakeMapper(),
+		MaxObjectBytes: 300,
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		configMap("ns", "big", map[string]interface{}{"file": strings.Repeat("b", 400)}),
+		configMap("ns", "same", map[string]interface{}{"file": strings.Repeat("a", 300)}),
+		configMap("ns", "small", map[string]interface{}{"foo": "new"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, DiffStatusChanged, result.Objects[0].Status)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+	require.Equal(t, DiffStatusChanged, result.Objects[2].Status)
+
+	out := buf.String()
+	require.Regexp(t, `ConfigMap/ns/big changed: object too large to diff \(5\d\d bytes\), showing size change only: 4\d\d -> 5\d\d bytes\n`, out)
+	require.NotContains(t, out, "aaaa")
+	require.Contains(t, out, "ConfigMap/ns/same unchanged\n")
+	require.Contains(t, out, `+     "foo": "new"`)
+}
+
+func TestDiffTimeout(t *testing.T) {
+	liveData := map[string]interface{}{}
+	configData := map[string]interface{}{}
+	for i := 0; i < 500; i++ {
+		liveData[fmt.Sprintf("k%03d", i)] = fmt.Sprintf("v%d", i%7)
+		configData[fmt.Sprintf("k%03d", i)] = fmt.Sprintf("v%d", i%5)
+	}
+	live := configMap("ns", "cm", liveData)
+	config := configMap("ns", "cm", configData)
+
+	for _, timeout := range []time.Duration{time.Nanosecond, -1} {
+		c := DiffCmd{DiffTimeout: timeout}
+		diff, err := c.diffObjects(live, config, nil)
+		require.NoError(t, err)
+
+		// However minimal, the diff must still be correct
+		var liveText, configText string
+		for _, d := range diff {
+			if d.Type != diffmatchpatch.DiffInsert {
+				liveText += d.Text
+			}
+			if d.Type != diffmatchpatch.DiffDelete {
+				configText += d.Text
+			}
+		}
+		expected, err := marshalIndent(live.Object, "  ")
+		require.NoError(t, err)
+		require.Equal(t, string(expected), liveText, "timeout %s", timeout)
+		expected, err = marshalIndent(config.Object, "  ")
+		require.NoError(t, err)
+		require.Equal(t, string(expected), configText, "timeout %s", timeout)
+	}
+}
+
+func TestDiffPreProcess(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.SetLabels(map[string]string{"build": "123"})
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	config.SetLabels(map[string]string{"build": "456"})
+
+	c := DiffCmd{
+		Client: newFakeDynamic(live),
+		Mapper: newFakeMapper(),
+		PreProcess: func(obj *unstructured.Unstructured) error {
+			unstructured.RemoveNestedField(obj.Object, "metadata", "labels", "build")
+			return nil
+		},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), "ConfigMap/ns/cm unchanged")
+	// Objects passed to PreProcess are copies
+	require.Equal(t, "456", config.GetLabels()["build"])
+
+	c.PreProcess = func(obj *unstructured.Unstructured) error {
+		return fmt.Errorf("bad object")
+	}
+	err := c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.EqualError(t, err, "Error diffing ConfigMap/ns/cm: bad object")
+}
+
+func TestDiffNormalizeAPIVersion(t *testing.T) {
+	live := deployment("ns", "web", int64(3))
+	config := deployment("ns", "web", int64(3))
+	config.SetAPIVersion("apps/v1beta1")
+
+	c := DiffCmd{
+		Client:              newFakeDynamic(live),
+		Mapper:              newFakeMapper(),
+		NormalizeAPIVersion: true,
+	}
+	var buf bytes.Buffer
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), "Deployment/ns/web unchanged")
+	require.Equal(t, "apps/v1beta1", config.GetAPIVersion())
+
+	c.NormalizeAPIVersion = false
+	require.Error(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+}
+
+// logHook records log entries
+type logHook struct {
+	entries []*log.Entry
+}
+
+func (h *logHook) Levels() []log.Level { return log.AllLevels }
+func (h *logHook) Fire(e *log.Entry) error {
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+// emptySchemaDiscovery serves an OpenAPI schema without any
+// definitions.
+type emptySchemaDiscovery struct {
+	discovery.DiscoveryInterface
+}
+
+func (emptySchemaDiscovery) OpenAPISchema() (*openapi_v2.Document, error) {
+	return &openapi_v2.Document{}, nil
+}
+
+func TestDiffEmptySchema(t *testing.T) {
+	logger := log.StandardLogger()
+	oldHooks, oldLevel, oldOut := logger.Hooks, logger.Level, logger.Out
+	defer func() {
+		logger.Hooks, logger.Level, logger.Out = oldHooks, oldLevel, oldOut
+	}()
+	hook := &logHook{}
+	logger.Hooks = log.LevelHooks{}
+	logger.AddHook(hook)
+	logger.SetLevel(log.DebugLevel)
+	logger.Out = ioutil.Discard
+
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "a", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "b", map[string]interface{}{"foo": "old"}),
+		),
+		Mapper:       newFakeMapper(),
+		Discovery:    emptySchemaDiscovery{},
+		DiffStrategy: DiffStrategyThreeWay,
+	}
+	result, err := c.Diff([]*unstructured.Unstructured{
+		configMap("ns", "a", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "b", map[string]interface{}{"foo": "new"}),
+	}, ioutil.Discard)
+	require.Equal(t, ErrModifications, err)
+	require.True(t, result.Objects[0].NoSchema)
+	require.True(t, result.Objects[1].NoSchema)
+
+	var warnings []string
+	for _, e := range hook.entries {
+		if e.Level <= log.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+		require.NotContains(t, e.Message, "Ignoring invalid schema")
+	}
+	require.Equal(t, []string{"Server's OpenAPI schema has no resource kinds, diffing without a schema"}, warnings)
+}
+
+func TestDiffLogFields(t *testing.T) {
+	logger := log.StandardLogger()
+	oldHooks, oldLevel, oldOut := logger.Hooks, logger.Level, logger.Out
+	defer func() {
+		logger.Hooks, logger.Level, logger.Out = oldHooks, oldLevel, oldOut
+	}()
+	hook := &logHook{}
+	logger.Hooks = log.LevelHooks{}
+	logger.AddHook(hook)
+	logger.SetLevel(log.DebugLevel)
+	logger.Out = ioutil.Discard
+
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+	}
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "new"}),
+	}, &buf))
+
+	var entry *log.Entry
+	for _, e := range hook.entries {
+		if e.Message == "Diffed object" {
+			entry = e
+		}
+	}
+	require.NotNil(t, entry)
+	require.Equal(t, log.DebugLevel, entry.Level)
+	require.Equal(t, "ConfigMap", entry.Data["kind"])
+	require.Equal(t, "ns", entry.Data["namespace"])
+	require.Equal(t, "cm", entry.Data["name"])
+	require.Equal(t, true, entry.Data["changed"])
+	require.IsType(t, time.Duration(0), entry.Data["fetchDuration"])
+	require.IsType(t, time.Duration(0), entry.Data["diffDuration"])
+}
+
+func TestDiffServerMetadata(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.SetResourceVersion("12345")
+	live.SetUID("8d0d7c5e-0c52-11e9-ab14-d663bd873d93")
+	live.SetGeneration(2)
+	live.SetSelfLink("/api/v1/namespaces/ns/configmaps/cm")
+	live.SetCreationTimestamp(metav1.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	for _, strategy := range []string{"", "subset", DiffStrategyThreeWay} {
+		c := DiffCmd{
+			Client:       newFakeDynamic(live),
+			Mapper:       newFakeMapper(),
+			DiffStrategy: strategy,
+		}
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{
+			configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		}, &buf)
+		require.NoError(t, err, "strategy %q", strategy)
+		require.Contains(t, buf.String(), "ConfigMap/ns/cm unchanged")
+		require.NotContains(t, buf.String(), "resourceVersion")
+	}
+
+	c := DiffCmd{
+		Client:             newFakeDynamic(live),
+		Mapper:             newFakeMapper(),
+		Context:            -1,
+		KeepServerMetadata: true,
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), `-     "resourceVersion": "12345",`)
+}
+
+func TestDiffManagedFields(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.Object["metadata"].(map[string]interface{})["managedFields"] = []interface{}{
+		map[string]interface{}{
+			"manager":    "kubectl",
+			"operation":  "Update",
+			"apiVersion": "v1",
+			"fieldsV1":   map[string]interface{}{"f:data": map[string]interface{}{"f:foo": map[string]interface{}{}}},
+		},
+	}
+
+	for _, strategy := range []string{"", "subset", DiffStrategyThreeWay} {
+		c := DiffCmd{
+			Client:       newFakeDynamic(live),
+			Mapper:       newFakeMapper(),
+			DiffStrategy: strategy,
+		}
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{
+			configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		}, &buf)
+		require.NoError(t, err, "strategy %q", strategy)
+		require.Contains(t, buf.String(), "ConfigMap/ns/cm unchanged")
+	}
+
+	c := DiffCmd{
+		Client:            newFakeDynamic(live),
+		Mapper:            newFakeMapper(),
+		Context:           -1,
+		KeepManagedFields: true,
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), `-         "manager": "kubectl",`)
+}
+
+func TestDiffIndent(t *testing.T) {
+	c := DiffCmd{
+		Client:  newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper:  newFakeMapper(),
+		Context: -1,
+		Indent:  "\t",
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "new"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Contains(t, buf.String(), "- \t\t\"foo\": \"old\"\n+ \t\t\"foo\": \"new\"\n")
+
+	c.Indent = "--"
+	require.EqualError(t, c.Run(nil, &buf), `Invalid indent "--", must be spaces or tabs`)
+}
+
+func TestDiffWarnImmutable(t *testing.T) {
+	withSelector := func(obj *unstructured.Unstructured, app string) *unstructured.Unstructured {
+		obj.Object["spec"].(map[string]interface{})["selector"] = map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app": app},
+		}
+		return obj
+	}
+	immutableCM := configMap("ns", "frozen", map[string]interface{}{"foo": "old"})
+	immutableCM.Object["immutable"] = true
+
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			withSelector(deployment("ns", "moved", int64(1)), "old"),
+			withSelector(deployment("ns", "scaled", int64(1)), "web"),
+			immutableCM,
+		),
+		Mapper:        newFakeMapper(),
+		WarnImmutable: true,
+	}
+	frozen := configMap("ns", "frozen", map[string]interface{}{"foo": "new"})
+	frozen.Object["immutable"] = true
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		withSelector(deployment("ns", "moved", int64(1)), "new"),
+		withSelector(deployment("ns", "scaled", int64(2)), "web"),
+		frozen,
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, []string{"data"}, result.Objects[0].Immutable)
+	require.Equal(t, []string{"spec.selector"}, result.Objects[1].Immutable)
+	require.Empty(t, result.Objects[2].Immutable)
+
+	output := buf.String()
+	require.Contains(t, output, "WARNING: spec.selector is immutable, updating Deployment/ns/moved will fail\n")
+	require.Contains(t, output, "WARNING: data is immutable, updating ConfigMap/ns/frozen will fail\n")
+	require.NotContains(t, output, "Deployment/ns/scaled will fail")
+}
+
+func TestDiffSections(t *testing.T) {
+	live := deployment("ns", "d", int64(1))
+	live.SetLabels(map[string]string{"team": "a"})
+	live.Object["status"] = map[string]interface{}{"replicas": int64(1)}
+	config := deployment("ns", "d", int64(2))
+	config.SetLabels(map[string]string{"team": "b"})
+
+	c := DiffCmd{
+		Client:   newFakeDynamic(live),
+		Mapper:   newFakeMapper(),
+		Context:  -1,
+		Sections: []string{"metadata"},
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	output := buf.String()
+	require.Contains(t, output, `+       "team": "b"`)
+	require.Contains(t, output, `    "kind": "Deployment",`)
+	require.NotContains(t, output, "replicas")
+
+	buf.Reset()
+	c.Sections = []string{"spec", "status"}
+	err = c.Run([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	output = buf.String()
+	require.Contains(t, output, `+     "replicas": 2`)
+	require.Contains(t, output, `-   "status": {`)
+	require.NotContains(t, output, "team")
+}
+
+func TestDiffEqualityFunc(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "BAR"})
+
+	var calls int
+	c := DiffCmd{
+		Client: newFakeDynamic(live),
+		Mapper: newFakeMapper(),
+		EqualityFunc: func(live, config *unstructured.Unstructured) bool {
+			calls++
+			l, _, _ := unstructured.NestedString(live.Object, "data", "foo")
+			c, _, _ := unstructured.NestedString(config.Object, "data", "foo")
+			return strings.EqualFold(l, c)
+		},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), "ConfigMap/ns/cm unchanged")
+	require.Equal(t, 1, calls)
+
+	config = configMap("ns", "cm", map[string]interface{}{"foo": "baz"})
+	buf.Reset()
+	require.Equal(t, ErrModifications, c.Run([]*unstructured.Unstructured{config}, &buf))
+	require.Contains(t, buf.String(), `"foo": "baz"`)
+}
+
+// flakyLiveSource fails the first failures Gets of each object with
+// err
+type flakyLiveSource struct {
+	LiveSource
+	err      error
+	failures int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *flakyLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	s.mu.Lock()
+	s.calls++
+	fail := s.calls <= s.failures
+	s.mu.Unlock()
+	if fail {
+		return nil, s.err
+	}
+	return s.LiveSource.Get(obj)
+}
+
+func TestDiffRetryPolicy(t *testing.T) {
+	live := &ClusterLiveSource{
+		Client: newFakeDynamic(configMap("ns", "cm", nil)),
+		Mapper: newFakeMapper(),
+	}
+	gr := schema.GroupResource{Resource: "configmaps"}
+	policy := &wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3}
+
+	for _, test := range []struct {
+		err      error
+		failures int
+		policy   *wait.Backoff
+		ok       bool
+		calls    int
+	}{
+		{errors.NewTooManyRequests("busy", 1), 2, policy, true, 3},
+		{errors.NewTooManyRequests("busy", 1), 3, policy, false, 3},
+		{errors.NewTooManyRequests("busy", 1), 1, nil, false, 1},
+		{errors.NewServerTimeout(gr, "get", 1), 1, policy, true, 2},
+		{errors.NewForbidden(gr, "cm", fmt.Errorf("nope")), 1, policy, false, 1},
+	} {
+		source := &flakyLiveSource{LiveSource: live, err: test.err, failures: test.failures}
+		c := DiffCmd{
+			Mapper:      newFakeMapper(),
+			LiveSource:  source,
+			RetryPolicy: test.policy,
+		}
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{configMap("ns", "cm", nil)}, &buf)
+		if test.ok {
+			require.NoError(t, err, "%v", test.err)
+		} else {
+			require.Error(t, err, "%v", test.err)
+		}
+		require.Equal(t, test.calls, source.calls, "%v", test.err)
+	}
+}
+
+func TestDiffManagedAnnotations(t *testing.T) {
+	live := configMap("ns", "cm", map[string]interface{}{"foo": "bar"})
+	live.SetAnnotations(map[string]string{"example.com/build": "123"})
+	addOrigAnnotation(live)
+
+	for _, test := range []struct {
+		annotations []string
+		unchanged   bool
+		hidden      []string
+	}{
+		// Default
+		{nil, false, []string{AnnotationOrigObject}},
+		{[]string{}, false, nil},
+		{[]string{AnnotationOrigObject, "example.com/build"}, true, []string{AnnotationOrigObject, "example.com/build"}},
+	} {
+		c := DiffCmd{
+			Client:             newFakeDynamic(live),
+			Mapper:             newFakeMapper(),
+			Context:            -1,
+			ManagedAnnotations: test.annotations,
+		}
+		var buf bytes.Buffer
+		err := c.Run([]*unstructured.Unstructured{
+			configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		}, &buf)
+		output := buf.String()
+		if test.unchanged {
+			require.NoError(t, err)
+			require.Contains(t, output, "ConfigMap/ns/cm unchanged")
+		} else {
+			require.Equal(t, ErrModifications, err)
+		}
+		for _, anno := range []string{AnnotationOrigObject, "example.com/build"} {
+			hidden := false
+			for _, h := range test.hidden {
+				hidden = hidden || h == anno
+			}
+			require.Equal(t, !hidden, strings.Contains(output, anno), "%v: %s", test.annotations, anno)
+		}
+	}
+}
+
+func TestDiffShowCreateBody(t *testing.T) {
+	c := DiffCmd{
+		Client:         newFakeDynamic(),
+		Mapper:         newFakeMapper(),
+		Context:        -1,
+		OmitSecrets:    true,
+		ShowCreateBody: true,
+		DiffStrategy:   DiffStrategyThreeWay,
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		secret("ns", "s", map[string]interface{}{"pw": "aHVudGVyMg=="}),
+	}, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Equal(t, `---
+- live ConfigMap/ns/cm
++ config ConfigMap/ns/cm
+ConfigMap/ns/cm doesn't exist on server
++ {
++   "apiVersion": "v1",
++   "data": {
++     "foo": "bar"
++   },
++   "kind": "ConfigMap",
++   "metadata": {
++     "name": "cm",
++     "namespace": "ns"
++   }
++ }
+---
+- live Secret/ns/s
++ config Secret/ns/s
+Secret/ns/s doesn't exist on server
++ {
++   "apiVersion": "v1",
++   "data": {
++     "pw": "<omitted>"
++   },
++   "kind": "Secret",
++   "metadata": {
++     "name": "s",
++     "namespace": "ns"
++   },
++   "type": "Opaque"
++ }
+`, buf.String())
+
+	c.Stat = true
+	buf.Reset()
+	_ = c.Run([]*unstructured.Unstructured{configMap("ns", "cm", nil)}, &buf)
+	require.Equal(t, "ConfigMap/ns/cm doesn't exist on server\n", buf.String())
+}
+
+func TestDiffStrategyByKind(t *testing.T) {
+	live := withContainer(deployment("ns", "web", int64(3)), "app:1")
+	live.Object["spec"].(map[string]interface{})["paused"] = true
+	liveCM := configMap("ns", "cm", map[string]interface{}{"foo": "bar", "extra": "x"})
+
+	c := DiffCmd{
+		Client:       newFakeDynamic(live, liveCM),
+		Mapper:       newFakeMapper(),
+		DiffStrategy: "subset",
+		StrategyByKind: map[string]string{
+			"Deployment": "all",
+			"Secret":     DiffStrategySkip,
+		},
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		withContainer(deployment("ns", "web", int64(3)), "app:1"),
+		configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		secret("ns", "s", nil),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 2)
+	require.Equal(t, "ConfigMap", result.Objects[0].GroupVersionKind.Kind)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[0].Status)
+	require.Equal(t, "Deployment", result.Objects[1].GroupVersionKind.Kind)
+	require.Equal(t, DiffStatusChanged, result.Objects[1].Status)
+	require.NotContains(t, buf.String(), "Secret")
+
+	c.StrategyByKind = map[string]string{"Deployment": "update"}
+	_, err = c.Diff([]*unstructured.Unstructured{configMap("ns", "cm", nil)}, ioutil.Discard)
+	require.EqualError(t, err, `Unknown diff strategy "update" for Deployment`)
+
+	// Nor can the strategy they override be unknown
+	c.StrategyByKind, c.DiffStrategy = nil, "update"
+	_, err = c.Diff([]*unstructured.Unstructured{configMap("ns", "cm", nil)}, ioutil.Discard)
+	require.EqualError(t, err, `Unknown diff strategy "update"`)
+}
+
+func TestDiffStrategyAnnotation(t *testing.T) {
+	withStrategy := func(obj *unstructured.Unstructured, strategy string) *unstructured.Unstructured {
+		obj.SetAnnotations(map[string]string{AnnotationDiffStrategy: strategy})
+		return obj
+	}
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			withStrategy(configMap("ns", "subset", map[string]interface{}{"foo": "bar", "extra": "x"}), "subset"),
+			configMap("ns", "all", map[string]interface{}{"foo": "bar", "extra": "x"}),
+		),
+		Mapper:         newFakeMapper(),
+		StrategyByKind: map[string]string{"Secret": "subset"},
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		withStrategy(configMap("ns", "subset", map[string]interface{}{"foo": "bar"}), "subset"),
+		configMap("ns", "all", map[string]interface{}{"foo": "bar"}),
+		withStrategy(secret("ns", "s", nil), DiffStrategySkip),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 2)
+	require.Equal(t, "all", result.Objects[0].Name)
+	require.Equal(t, DiffStatusChanged, result.Objects[0].Status)
+	require.Equal(t, "subset", result.Objects[1].Name)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+	require.NotContains(t, buf.String(), "Secret")
+
+	err = c.Run([]*unstructured.Unstructured{withStrategy(configMap("ns", "cm", nil), "sometimes")}, &buf)
+	require.EqualError(t, err, `Object 0 has unknown `+AnnotationDiffStrategy+` "sometimes"`)
+}
+
+func TestDiffOrder(t *testing.T) {
+	ns := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata":   map[string]interface{}{"name": "ns"},
+		},
+	}
+	objs := func() []*unstructured.Unstructured {
+		return []*unstructured.Unstructured{
+			deployment("ns", "app", int64(1)),
+			configMap("ns", "cm", nil),
+			ns,
+		}
+	}
+	names := func(r *DiffResult) []string {
+		var ret []string
+		for _, o := range r.Objects {
+			ret = append(ret, o.GroupVersionKind.Kind+"/"+o.Name)
+		}
+		return ret
+	}
+
+	c := DiffCmd{
+		Client:    newFakeDynamic(),
+		Mapper:    newFakeMapper(),
+		Discovery: fakeSchemaDiscovery{},
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff(objs(), &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Equal(t, []string{"Namespace/ns", "Deployment/app", "ConfigMap/cm"}, names(result))
+
+	c.Order = DiffOrderApply
+	result, err = c.Diff(objs(), &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Equal(t, []string{"Namespace/ns", "ConfigMap/cm", "Deployment/app"}, names(result))
+
+	c.Discovery = nil
+	require.EqualError(t, c.Run(objs(), &buf), "The apply order requires a server")
+	c.Order = "random"
+	require.EqualError(t, c.Run(objs(), &buf), `Unknown diff order "random"`)
+}
+
+// resourceDiscovery is a fakeSchemaDiscovery that also serves
+// ServerResources
+type resourceDiscovery struct {
+	fakeSchemaDiscovery
+	resources []*metav1.APIResourceList
+}
+
+func (d resourceDiscovery) ServerResources() ([]*metav1.APIResourceList, error) {
+	return d.resources, nil
+}
+
+func (d resourceDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	for _, list := range d.resources {
+		if list.GroupVersion == groupVersion {
+			return list, nil
+		}
+	}
+	gv, _ := schema.ParseGroupVersion(groupVersion)
+	return nil, errors.NewNotFound(schema.GroupResource{Group: gv.Group}, "")
+}
+
+func TestDiffStrictCRD(t *testing.T) {
+	// Mapped from a stale cache, but no longer served
+	mapper := newFakeMapper().(*meta.DefaultRESTMapper)
+	mapper.Add(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, meta.RESTScopeNamespace)
+	widget := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "w", "namespace": "ns"},
+	}}
+	c := DiffCmd{
+		Client: newFakeDynamic(),
+		Mapper: mapper,
+		Discovery: resourceDiscovery{
+			resources: []*metav1.APIResourceList{{
+				GroupVersion: "v1",
+				APIResources: []metav1.APIResource{{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"}},
+			}},
+		},
+	}
+	config := []*unstructured.Unstructured{widget, configMap("ns", "cm", nil)}
+	require.Equal(t, ErrCreatesOnly, c.Run(config, ioutil.Discard))
+
+	c.StrictCRD = true
+	err := c.Run(config, ioutil.Discard)
+	require.EqualError(t, err, "Kinds unknown to the server, are CRDs missing? Widget (example.com/v1)")
+
+	// Objects only to create are fine, if their kind is served
+	require.Equal(t, ErrCreatesOnly, c.Run([]*unstructured.Unstructured{configMap("ns", "cm", nil)}, ioutil.Discard))
+
+	// An object that couldn't be fetched reports why, not its kind
+	c.LiveSource = &slowLiveSource{LiveSource: &ClusterLiveSource{Client: c.Client, Mapper: mapper}, fail: "w"}
+	for _, continueOnError := range []bool{false, true} {
+		c.ContinueOnError = continueOnError
+		require.EqualError(t, c.Run(config, ioutil.Discard), "Error fetching Widget/ns/w: injected failure")
+	}
+	c.LiveSource, c.ContinueOnError = nil, false
+
+	c.Discovery = nil
+	require.Error(t, c.Run(config, ioutil.Discard))
+}
+
+func TestDiffSuggestKind(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(),
+		Mapper: newFakeMapper(),
+		Discovery: resourceDiscovery{
+			resources: []*metav1.APIResourceList{{
+				GroupVersion: "v1",
+				APIResources: []metav1.APIResource{
+					{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", ShortNames: []string{"cm"}},
+					{Name: "pods", Namespaced: true, Kind: "Pod", ShortNames: []string{"po"}},
+					{Name: "pods/log", Namespaced: true, Kind: "Pod"},
+				},
+			}, {
+				GroupVersion: "apps/v1",
+				APIResources: []metav1.APIResource{
+					{Name: "deployments", SingularName: "deployment", Namespaced: true, Kind: "Deployment", ShortNames: []string{"deploy"}},
+				},
+			}},
+		},
+	}
+
+	for kind, expected := range map[string]string{
+		"Deploymnet": "did you mean Deployment?",
+		"deploy":     "did you mean Deployment?",
+		"configmap":  "did you mean ConfigMap?",
+		"cm":         "did you mean ConfigMap?",
+		"Pdo":        `no matches for kind "Pdo" in version "apps/v1"`,
+		"Widget":     `no matches for kind "Widget" in version "apps/v1"`,
+	} {
+		obj := deployment("ns", "web", int64(1))
+		obj.SetKind(kind)
+		err := c.Run([]*unstructured.Unstructured{obj}, ioutil.Discard)
+		require.Error(t, err)
+		require.True(t, strings.HasSuffix(err.Error(), expected), "%s: %v", kind, err)
+	}
+}
+
+func TestDiffDetectOrphans(t *testing.T) {
+	tagged := func(obj *unstructured.Unstructured, tag string) *unstructured.Unstructured {
+		utils.SetMetaDataAnnotation(obj, AnnotationGcTag, tag)
+		return obj
+	}
+	disco := resourceDiscovery{
+		resources: []*metav1.APIResourceList{{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"get", "list"}},
+				{Name: "secrets", Namespaced: true, Kind: "Secret", Verbs: []string{"get", "list"}},
+			},
+		}},
+	}
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			tagged(configMap("ns", "kept", nil), "mytag"),
+			tagged(configMap("ns", "orphan", map[string]interface{}{"foo": "bar"}), "mytag"),
+			tagged(configMap("ns", "other", nil), "othertag"),
+			configMap("ns", "untagged", nil),
+			tagged(secret("ns", "s", map[string]interface{}{"pw": "aHVudGVyMg=="}), "mytag"),
+		),
+		Mapper:        newFakeMapper(),
+		Discovery:     disco,
+		DetectOrphans: true,
+		GcTag:         "mytag",
+		OmitSecrets:   true,
+		Context:       -1,
+	}
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		tagged(configMap("ns", "kept", nil), "mytag"),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 3)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[0].Status)
+	require.Equal(t, ObjectDiff{
+		GroupVersionKind: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Namespace:        "ns",
+		Name:             "orphan",
+		Status:           DiffStatusOrphaned,
+	}, result.Objects[1])
+	require.Equal(t, "s", result.Objects[2].Name)
+	require.Len(t, result.SelectObjects([]int{0, 1, 2}), 1)
+
+	output := buf.String()
+	require.Contains(t, output, "ConfigMap/ns/orphan isn't in config, and would be garbage collected\n- {\n")
+	require.Contains(t, output, `-     "foo": "bar"`)
+	require.Contains(t, output, "Secret/ns/s isn't in config")
+	require.NotContains(t, output, "aHVudGVyMg==")
+	require.NotContains(t, output, "ns/other")
+	require.NotContains(t, output, "ns/untagged")
+
+	c.GcTag = ""
+	require.Error(t, c.Run(nil, &buf))
+}
+
+// blockedLiveSource never returns until unblocked is closed
+type blockedLiveSource struct {
+	unblocked chan struct{}
+}
+
+func (s blockedLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	<-s.unblocked
+	return nil, nil
+}
+
+func TestDiffContext(t *testing.T) {
+	source := blockedLiveSource{unblocked: make(chan struct{})}
+	defer close(source.unblocked)
+	c := DiffCmd{
+		Mapper:      newFakeMapper(),
+		LiveSource:  source,
+		Concurrency: 2,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var buf bytes.Buffer
+	err := c.RunContext(ctx, []*unstructured.Unstructured{
+		configMap("ns", "a", nil),
+		configMap("ns", "b", nil),
+		configMap("ns", "c", nil),
+	}, &buf)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Empty(t, buf.String())
+
+	// Already cancelled, even with ContinueOnError
+	c.ContinueOnError = true
+	_, err = c.DiffContext(ctx, []*unstructured.Unstructured{configMap("ns", "a", nil)}, &buf)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDiffOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubecfg-diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outDir := filepath.Join(dir, "out")
+
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		),
+		Mapper:           newFakeMapper(),
+		OutputDir:        outDir,
+		DefaultNamespace: "default",
+	}
+
+	var buf bytes.Buffer
+	err = c.Run([]*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "bar"}),
+		configMap("", "new", nil),
+		deployment("ns", "web", int64(1)),
+		clusterRole("reader"),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Empty(t, buf.String())
+
+	files, err := ioutil.ReadDir(outDir)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	require.Equal(t, []string{
+		"ClusterRole.rbac.authorization.k8s.io_reader.diff",
+		"default_ConfigMap_new.diff",
+		"index.txt",
+		"ns_ConfigMap_changed.diff",
+		"ns_Deployment.apps_web.diff",
+	}, names)
+
+	changed, err := ioutil.ReadFile(filepath.Join(outDir, "ns_ConfigMap_changed.diff"))
+	require.NoError(t, err)
+	require.Contains(t, string(changed), "-     \"foo\": \"old\"\n+     \"foo\": \"new\"\n")
+
+	index, err := ioutil.ReadFile(filepath.Join(outDir, "index.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "created ConfigMap/default/new default_ConfigMap_new.diff\n"+
+		"created ClusterRole/reader ClusterRole.rbac.authorization.k8s.io_reader.diff\n"+
+		"changed ConfigMap/ns/changed ns_ConfigMap_changed.diff\n"+
+		"created Deployment/ns/web ns_Deployment.apps_web.diff\n", string(index))
+}
+
+func TestDiffOffline(t *testing.T) {
+	c := DiffCmd{
+		Offline:              true,
+		IgnoreServerDefaults: true,
+		Context:              -1,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		configMap("ns", "cm", map[string]interface{}{"foo": "bar"}),
+		clusterRole("admin"),
+	}, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Equal(t, 2, result.Count(DiffStatusCreated))
+
+	output := buf.String()
+	require.Contains(t, output, "ClusterRole/admin doesn't exist on server\n")
+	require.Contains(t, output, "ConfigMap/ns/cm doesn't exist on server\n")
+	require.Contains(t, output, `+     "foo": "bar"`)
+
+	c.FromFile = "live.yaml"
+	require.Error(t, c.Run(nil, &buf))
+}
+
+func TestDiffValidateObjects(t *testing.T) {
+	noKind := configMap("ns", "a", nil)
+	noKind.SetKind("")
+	noName := configMap("ns", "", nil)
+	noName.SetAPIVersion("")
+
+	c := DiffCmd{
+		Client: newFakeDynamic(),
+		Mapper: newFakeMapper(),
+	}
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{configMap("ns", "ok", nil), noKind, noName}, &buf)
+	require.EqualError(t, err, "[Object 1 is missing kind, Object 2 is missing apiVersion, name]")
+	require.Empty(t, buf.String())
+}
+
+func TestDiffIncludeDependents(t *testing.T) {
+	owns := func(obj, owner *unstructured.Unstructured) *unstructured.Unstructured {
+		obj.SetOwnerReferences(append(obj.GetOwnerReferences(), metav1.OwnerReference{
+			APIVersion: owner.GetAPIVersion(),
+			Kind:       owner.GetKind(),
+			Name:       owner.GetName(),
+			UID:        owner.GetUID(),
+		}))
+		return obj
+	}
+	web := deployment("ns", "web", int64(1))
+	web.SetUID("web-uid")
+	rs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "ReplicaSet",
+		"metadata":   map[string]interface{}{"name": "web-1", "namespace": "ns", "uid": "rs-uid"},
+		"status":     map[string]interface{}{"readyReplicas": int64(1)},
+	}}
+	owns(rs, web)
+	pod := owns(configMap("ns", "web-1-pod", nil), rs)
+	pod.SetUID("pod-uid")
+	other := owns(configMap("ns", "unrelated", nil), configMap("ns", "x", nil))
+
+	disco := resourceDiscovery{
+		resources: []*metav1.APIResourceList{{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"list"}},
+			},
+		}, {
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"list"}},
+				{Name: "replicasets", Namespaced: true, Kind: "ReplicaSet", Verbs: []string{"list"}},
+			},
+		}},
+	}
+	c := DiffCmd{
+		Client:            newFakeDynamic(web, rs, pod, other),
+		Mapper:            newFakeMapper(),
+		Discovery:         disco,
+		IncludeDependents: true,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{deployment("ns", "web", int64(1))}, &buf)
+	require.NoError(t, err)
+
+	output := buf.String()
+	require.Contains(t, output, "Deployment/ns/web unchanged\nReplicaSet/ns/web-1 is owned by Deployment/ns/web\n  {\n")
+	require.Contains(t, output, `      "readyReplicas": 1`)
+	require.Contains(t, output, "ConfigMap/ns/web-1-pod is owned by Deployment/ns/web\n")
+	require.NotContains(t, output, "unrelated")
+
+	c.Discovery = nil
+	require.EqualError(t, c.Run(nil, &buf), "Including dependents requires a server")
+}
+
+func TestDiffFormatNames(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", nil),
+			deployment("ns", "web", int64(1)),
+		),
+		Mapper: newFakeMapper(),
+		Format: DiffFormatNames,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", nil),
+		configMap("ns", "new", nil),
+		deployment("ns", "web", int64(2)),
+		clusterRole("admin"),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, `+ rbac.authorization.k8s.io/v1/ClusterRole/admin
+~ v1/ConfigMap/ns/changed
++ v1/ConfigMap/ns/new
+= v1/ConfigMap/ns/same
+~ apps/v1/Deployment/ns/web
+`, buf.String())
+}
+
+func TestDiffShowHash(t *testing.T) {
+	config := configMap("ns", "cm", map[string]interface{}{"foo": "new"})
+	c := DiffCmd{
+		Client:   newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper:   newFakeMapper(),
+		ShowHash: true,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrModifications, err)
+	hash := result.Objects[0].Hash
+	require.Len(t, hash, 12)
+	require.Contains(t, buf.String(), "\n+ config ConfigMap/ns/cm @"+hash+"\n")
+
+	// Independent of the live object
+	c.Client = newFakeDynamic()
+	result, err = c.Diff([]*unstructured.Unstructured{config}, ioutil.Discard)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Equal(t, hash, result.Objects[0].Hash)
+
+	result, err = c.Diff([]*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "newer"})}, ioutil.Discard)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.NotEqual(t, hash, result.Objects[0].Hash)
+
+	c.ShowHash = false
+	result, err = c.Diff([]*unstructured.Unstructured{config}, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Empty(t, result.Objects[0].Hash)
+}
+
+func TestDiffSummary(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", nil),
+		),
+		Mapper:  newFakeMapper(),
+		Summary: true,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", nil),
+		configMap("ns", "new", nil),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.True(t, strings.HasSuffix(buf.String(), "\nSummary: 3 objects, 1 changed, 1 to create, 1 unchanged\n"))
+}
+
+func TestDiffStatus(t *testing.T) {
+	var out, status bytes.Buffer
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", nil),
+		),
+		Mapper: newFakeMapper(),
+		Status: &status,
+	}
+	objs := []*unstructured.Unstructured{
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "same", nil),
+		configMap("ns", "new", nil),
+	}
+
+	require.Equal(t, ErrModifications, c.Run(objs, &out))
+	require.Equal(t, `{"changed":1,"created":1,"unchanged":1,"orphaned":0,"errors":0}`+"\n", status.String())
+	require.NotContains(t, out.String(), `"changed"`)
+
+	// Once for all targets
+	status.Reset()
+	c.Targets = []DiffTarget{
+		{Name: "a", Client: c.Client, Mapper: c.Mapper},
+		{Name: "b", Client: newFakeDynamic(), Mapper: c.Mapper},
+	}
+	require.Equal(t, ErrModifications, c.Run(objs, ioutil.Discard))
+	require.Equal(t, `{"changed":1,"created":4,"unchanged":1,"orphaned":0,"errors":0}`+"\n", status.String())
+}
+
+func TestDiffMatchBy(t *testing.T) {
+	const key = "example.com/job"
+	labelled := func(name, value string, data map[string]interface{}) *unstructured.Unstructured {
+		obj := configMap("ns", name, data)
+		obj.SetLabels(map[string]string{key: value})
+		return obj
+	}
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			labelled("run-x7k2p", "run", map[string]interface{}{"foo": "old"}),
+			labelled("dup-1", "dup", nil),
+			labelled("dup-2", "dup", nil),
+		),
+		Mapper:  newFakeMapper(),
+		MatchBy: key,
+	}
+	generated := func(value string) *unstructured.Unstructured {
+		obj := labelled("", value, map[string]interface{}{"foo": "new"})
+		obj.SetGenerateName(value + "-")
+		return obj
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{generated("run"), generated("new")}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, 1, result.Count(DiffStatusCreated))
+	for _, obj := range result.Objects {
+		if obj.Status == DiffStatusChanged {
+			require.Equal(t, "run-x7k2p", obj.Name)
+		}
+	}
+	require.Contains(t, buf.String(), "- live ConfigMap/ns/run-x7k2p\n")
+
+	err = c.Run([]*unstructured.Unstructured{generated("dup")}, &buf)
+	require.EqualError(t, err, "Error fetching ConfigMap/ns/: 2 live ConfigMap objects match example.com/job=dup, expected at most one")
+
+	err = c.Run([]*unstructured.Unstructured{configMap("ns", "", nil)}, &buf)
+	require.EqualError(t, err, "Object 0 is missing name and example.com/job label")
+}
+
+func TestDiffAgainstPrevious(t *testing.T) {
+	live := configMap("ns", "drifted", map[string]interface{}{"foo": "edited"})
+	utils.SetMetaDataAnnotation(live, AnnotationPrevious,
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: drifted\n  namespace: ns\ndata:\n  foo: applied\n")
+	same := configMap("ns", "same", map[string]interface{}{"k": "v"})
+	utils.SetMetaDataAnnotation(same, AnnotationPrevious, `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"same","namespace":"ns"},"data":{"k":"v"}}`)
+	bad := configMap("ns", "bad", nil)
+	utils.SetMetaDataAnnotation(bad, AnnotationPrevious, "{")
+
+	c := DiffCmd{
+		Client:  newFakeDynamic(live, same, configMap("ns", "unrecorded", nil)),
+		Mapper:  newFakeMapper(),
+		Against: AgainstPreviousAnnotation,
+		Context: -1,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		// Config contents are ignored
+		configMap("ns", "drifted", map[string]interface{}{"foo": "config"}),
+		configMap("ns", "same", map[string]interface{}{"foo": "config"}),
+		configMap("ns", "unrecorded", map[string]interface{}{"foo": "config"}),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, DiffStatusChanged, result.Objects[0].Status)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[2].Status)
+
+	output := buf.String()
+	require.Contains(t, output, "- previous ConfigMap/ns/drifted\n+ live ConfigMap/ns/drifted\n")
+	require.Contains(t, output, `-     "foo": "applied"`+"\n"+`+     "foo": "edited"`)
+	require.NotContains(t, output, "config")
+	require.NotContains(t, output, AnnotationPrevious)
+	require.Contains(t, output, "ConfigMap/ns/same unchanged\n")
+	require.Contains(t, output, "ConfigMap/ns/unrecorded has no previous version\n")
+
+	c.Client = newFakeDynamic(bad)
+	err = c.Run([]*unstructured.Unstructured{configMap("ns", "bad", nil)}, &buf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Invalid "+AnnotationPrevious+" annotation")
+
+	c.Against = "bogus"
+	require.EqualError(t, c.Run(nil, &buf), `Unknown diff against "bogus"`)
+}
+
+func TestDiffPager(t *testing.T) {
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+		Pager:  "sed 's/^/| /'",
+	}
+	config := []*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}
+
+	// Not a terminal
+	var buf bytes.Buffer
+	require.Equal(t, ErrModifications, c.Run(config, &buf))
+	require.True(t, strings.HasPrefix(buf.String(), "---\n"))
+
+	buf.Reset()
+	_, err := c.page(context.Background(), config, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.True(t, strings.HasPrefix(buf.String(), "| ---\n| - live ConfigMap/ns/cm\n"))
+	require.NotContains(t, buf.String(), "\x1b[")
+
+	c.Pager = "exit 3"
+	_, err = c.page(context.Background(), nil, &buf)
+	require.EqualError(t, err, `Error running pager "exit 3": exit status 3`)
+}
+
+func TestDiffSinks(t *testing.T) {
+	var colored, plain, auto bytes.Buffer
+	c := DiffCmd{
+		Client: newFakeDynamic(configMap("ns", "cm", map[string]interface{}{"foo": "old"})),
+		Mapper: newFakeMapper(),
+		Color:  DiffColorAlways,
+		Sinks: []DiffSink{
+			{Writer: &plain, Color: DiffColorNever},
+			{Writer: &auto},
+		},
+	}
+	config := []*unstructured.Unstructured{configMap("ns", "cm", map[string]interface{}{"foo": "new"})}
+
+	result, err := c.Diff(config, &colored)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 1)
+	require.Contains(t, colored.String(), "\x1b[31m-     \"foo\": \"old\"")
+	require.Contains(t, plain.String(), "\n-     \"foo\": \"old\"")
+	require.NotContains(t, plain.String(), "\x1b[")
+	require.Equal(t, plain.String(), auto.String())
+
+	// Without colors, every writer gets the same output
+	c.Color = DiffColorNever
+	colored.Reset()
+	plain.Reset()
+	require.Equal(t, ErrModifications, c.Run(config, &colored))
+	require.Equal(t, colored.String(), plain.String())
+
+	c.Sinks = []DiffSink{{Writer: &plain, Color: "sometimes"}}
+	require.EqualError(t, c.Run(config, &colored), `Unknown diff color setting "sometimes"`)
+}
+
+func TestDiffLabelSelector(t *testing.T) {
+	labelled := func(name, app string) *unstructured.Unstructured {
+		obj := configMap("ns", name, nil)
+		if app != "" {
+			obj.SetLabels(map[string]string{"app": app})
+		}
+		return obj
+	}
+	c := DiffCmd{
+		Client:        newFakeDynamic(),
+		Mapper:        newFakeMapper(),
+		LabelSelector: "app=frontend",
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{
+		labelled("web", "frontend"),
+		labelled("db", "backend"),
+		labelled("other", ""),
+	}, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "web", result.Objects[0].Name)
+	require.NotContains(t, buf.String(), "ns/db")
+
+	c.LabelSelector = "app in (frontend"
+	require.Error(t, c.Run(nil, &buf))
+}
+
+func TestDiffOnlySourcePaths(t *testing.T) {
+	a, b, unknown := configMap("ns", "a", nil), configMap("ns", "b", nil), configMap("ns", "unknown", nil)
+	c := DiffCmd{
+		Client: newFakeDynamic(),
+		Mapper: newFakeMapper(),
+		SourcePaths: map[*unstructured.Unstructured]string{
+			a: "app/a.jsonnet",
+			b: "app/b.jsonnet",
+		},
+		OnlySourcePaths: []string{"./app/b.jsonnet"},
+	}
+	objs := []*unstructured.Unstructured{a, b, unknown}
+
+	result, err := c.Diff(objs, ioutil.Discard)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "b", result.Objects[0].Name)
+
+	// Nothing changed
+	c.OnlySourcePaths = []string{}
+	result, err = c.Diff(objs, ioutil.Discard)
+	require.NoError(t, err)
+	require.Empty(t, result.Objects)
+
+	c.OnlySourcePaths = nil
+	result, err = c.Diff(objs, ioutil.Discard)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Len(t, result.Objects, 3)
+}
+
+func TestDiffNamespaces(t *testing.T) {
+	c := DiffCmd{
+		Client:           newFakeDynamic(),
+		Mapper:           newFakeMapper(),
+		DefaultNamespace: "team-a",
+		Namespaces:       []string{"team-a", "team-b"},
+	}
+	objs := []*unstructured.Unstructured{
+		configMap("team-a", "a", nil),
+		configMap("", "defaulted", nil),
+		configMap("team-b", "b", nil),
+		configMap("team-c", "c", nil),
+		clusterRole("admin"),
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff(objs, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	var names []string
+	for _, obj := range result.Objects {
+		names = append(names, obj.Name)
+	}
+	require.Equal(t, []string{"defaulted", "a", "b"}, names)
+
+	c.IncludeClusterScoped = true
+	result, err = c.Diff(objs, &buf)
+	require.Equal(t, ErrCreatesOnly, err)
+	require.Len(t, result.Objects, 4)
+	require.Equal(t, "admin", result.Objects[0].Name)
+}
+
+func TestDiffTargets(t *testing.T) {
+	cm := func(foo string) *unstructured.Unstructured {
+		return configMap("ns", "cm", map[string]interface{}{"foo": foo})
+	}
+	c := DiffCmd{
+		Targets: []DiffTarget{
+			{Name: "prod", Client: newFakeDynamic(cm("old")), Mapper: newFakeMapper()},
+			{Name: "staging", Client: newFakeDynamic(cm("new")), Mapper: newFakeMapper()},
+			{Name: "dev", Client: newFakeDynamic(), Mapper: newFakeMapper()},
+		},
+		Context: -1,
+	}
+
+	var buf bytes.Buffer
+	result, err := c.Diff([]*unstructured.Unstructured{cm("new")}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.Len(t, result.Objects, 3)
+	require.Equal(t, "staging", result.Objects[1].Target)
+	require.Equal(t, DiffStatusUnchanged, result.Objects[1].Status)
+
+	output := buf.String()
+	require.True(t, strings.HasPrefix(output, "=== prod\n---\n"))
+	require.Contains(t, output, "=== staging\n---\n- live ConfigMap/ns/cm\n+ config ConfigMap/ns/cm\nConfigMap/ns/cm unchanged\n")
+	require.Contains(t, output, "=== dev\n")
+	require.True(t, strings.HasSuffix(output, "=== Summary\nConfigMap/ns/cm: prod=changed staging=unchanged dev=created\n"))
+
+	// No differences anywhere
+	c.Targets = c.Targets[1:2]
+	require.NoError(t, c.Run([]*unstructured.Unstructured{cm("new")}, ioutil.Discard))
+
+	// Orphans are differences too
+	orphan := configMap("ns", "orphan", nil)
+	utils.SetMetaDataAnnotation(orphan, AnnotationGcTag, "mytag")
+	disco := resourceDiscovery{
+		resources: []*metav1.APIResourceList{{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"get", "list"}},
+			},
+		}},
+	}
+	c.Targets = []DiffTarget{{Name: "staging", Client: newFakeDynamic(cm("new"), orphan), Mapper: newFakeMapper(), Discovery: disco}}
+	c.DetectOrphans, c.GcTag = true, "mytag"
+	result, err = c.Diff([]*unstructured.Unstructured{cm("new")}, ioutil.Discard)
+	require.Equal(t, ErrModifications, err)
+	require.Equal(t, 1, result.Count(DiffStatusOrphaned))
+	c.DetectOrphans, c.GcTag = false, ""
+
+	c.FromFile = "manifests"
+	require.Error(t, c.Run(nil, ioutil.Discard))
+}
+
+func TestDiffQuiet(t *testing.T) {
+	same := configMap("ns", "same", map[string]interface{}{"foo": "bar"})
+	c := DiffCmd{
+		Client:  newFakeDynamic(same, configMap("ns", "changed", map[string]interface{}{"foo": "old"})),
+		Mapper:  newFakeMapper(),
+		Quiet:   true,
+		Context: -1,
+	}
+
+	var buf bytes.Buffer
+	err := c.Run([]*unstructured.Unstructured{
+		same.DeepCopy(),
+		configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+		configMap("ns", "created", nil),
+	}, &buf)
+	require.Equal(t, ErrModifications, err)
+	require.NotContains(t, buf.String(), "ns/same")
+	require.Contains(t, buf.String(), "ConfigMap/ns/changed")
+	require.Contains(t, buf.String(), "ConfigMap/ns/created doesn't exist on server")
+
+	// No output at all when nothing changed
+	buf.Reset()
+	require.NoError(t, c.Run([]*unstructured.Unstructured{same.DeepCopy()}, &buf))
+	require.Empty(t, buf.String())
+}
+
+func TestDiffFilter(t *testing.T) {
+	config := func() []*unstructured.Unstructured {
+		return []*unstructured.Unstructured{
+			configMap("ns", "changed", map[string]interface{}{"foo": "new"}),
+			configMap("ns", "created", map[string]interface{}{"foo": "new"}),
+			configMap("ns", "same", map[string]interface{}{"foo": "old"}),
+		}
+	}
+	c := DiffCmd{
+		Client: newFakeDynamic(
+			configMap("ns", "changed", map[string]interface{}{"foo": "old"}),
+			configMap("ns", "same", map[string]interface{}{"foo": "old"}),
+		),
+		Mapper: newFakeMapper(),
+	}
+
+	for _, tc := range []struct {
+		filter         string
+		shown, notShow []string
+	}{
+		{filter: "", shown: []string{"ns/changed", "ns/created", "ns/same"}},
+		{filter: DiffFilterAll, shown: []string{"ns/changed", "ns/created", "ns/same"}},
+		{filter: DiffFilterCreated, shown: []string{"ns/created"}, notShow: []string{"ns/changed", "ns/same"}},
+		{filter: DiffFilterChanged, shown: []string{"ns/changed"}, notShow: []string{"ns/created", "ns/same"}},
+	} {
+		c.Filter = tc.filter
+		var buf bytes.Buffer
+		result, err := c.Diff(config(), &buf)
+		// Return value is independent of the filter
+		require.Equal(t, ErrModifications, err)
+		require.Len(t, result.Objects, 3)
+		for _, s := range tc.shown {
+			require.Contains(t, buf.String(), s, "filter %q", tc.filter)
+		}
+		for _, s := range tc.notShow {
+			require.NotContains(t, buf.String(), s, "filter %q", tc.filter)
+		}
+	}
+
+	// Only an unchanged object left, so nothing shown but no diff
+	c.Filter = DiffFilterChanged
+	var buf bytes.Buffer
+	require.NoError(t, c.Run(config()[2:], &buf))
+	require.Empty(t, buf.String())
+
+	c.Filter = "bogus"
+	require.Error(t, c.Run(nil, &buf))
 }
@@ -0,0 +1,178 @@
+// Copyright 2017 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package kubecfg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	jsonnet "github.com/google/go-jsonnet"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/bitnami/kubecfg/utils"
+)
+
+// LiveSource provides the "live" version of config objects, to
+// compare them against.  Get may be called concurrently, see
+// DiffCmd.Concurrency.
+type LiveSource interface {
+	// Get returns the live version of obj, or nil if there
+	// isn't one.
+	Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+}
+
+// ClusterLiveSource fetches live objects from the server.
+type ClusterLiveSource struct {
+	Client           dynamic.Interface
+	Mapper           meta.RESTMapper
+	DefaultNamespace string
+	// MatchBy, see DiffCmd.MatchBy
+	MatchBy string
+}
+
+// Get implements LiveSource
+func (s *ClusterLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	client, err := utils.ClientForResource(s.Client, s.Mapper, obj, s.DefaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.GetName() == "" && s.MatchBy != "" {
+		selector := labels.SelectorFromSet(labels.Set{s.MatchBy: obj.GetLabels()[s.MatchBy]})
+		list, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, err
+		}
+		switch len(list.Items) {
+		case 0:
+			return nil, nil
+		case 1:
+			return &list.Items[0], nil
+		}
+		return nil, fmt.Errorf("%d live %s objects match %s, expected at most one", len(list.Items), obj.GetKind(), selector)
+	}
+
+	liveObj, err := client.Get(obj.GetName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return liveObj, err
+}
+
+// emptyLiveSource has no live objects, see DiffCmd.Offline.
+type emptyLiveSource struct{}
+
+// Get implements LiveSource
+func (emptyLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return nil, nil
+}
+
+// FileLiveSource serves live objects from a set of saved manifests,
+// matched to config objects by group, kind, namespace and name.
+type FileLiveSource struct {
+	DefaultNamespace string
+
+	objects map[string]*unstructured.Unstructured
+}
+
+// NewFileLiveSource reads the objects in the given manifest file, or
+// every .json, .yaml and .yml file found in the given directory.
+func NewFileLiveSource(path string, defaultNamespace string) (*FileLiveSource, error) {
+	var paths []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if ext := filepath.Ext(p); p == path || ext == ".json" || ext == ".yaml" || ext == ".yml" {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []*unstructured.Unstructured
+	vm := jsonnet.MakeVM()
+	for _, p := range paths {
+		log.Debugf("Reading live objects from %s", p)
+		fileObjs, err := utils.Read(vm, p)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %v", p, err)
+		}
+		objs = append(objs, utils.FlattenToV1(fileObjs)...)
+	}
+	return NewObjectLiveSource(objs, defaultNamespace), nil
+}
+
+// NewObjectLiveSource serves the given objects as live objects, like
+// a FileLiveSource.
+func NewObjectLiveSource(objs []*unstructured.Unstructured, defaultNamespace string) *FileLiveSource {
+	s := &FileLiveSource{
+		DefaultNamespace: defaultNamespace,
+		objects:          map[string]*unstructured.Unstructured{},
+	}
+	for _, obj := range objs {
+		s.objects[s.key(obj)] = obj
+	}
+	return s
+}
+
+func (s *FileLiveSource) key(obj *unstructured.Unstructured) string {
+	ns := obj.GetNamespace()
+	if ns == "" {
+		ns = s.DefaultNamespace
+	}
+	gk := obj.GroupVersionKind().GroupKind()
+	return fmt.Sprintf("%s/%s/%s", gk, ns, obj.GetName())
+}
+
+// unmatched returns the objects of s that aren't the live version
+// of any of objs, in alphabetical order.
+func (s *FileLiveSource) unmatched(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	matched := make(map[string]bool, len(objs))
+	for _, obj := range objs {
+		matched[s.key(obj)] = true
+	}
+	result := []*unstructured.Unstructured{}
+	for k, obj := range s.objects {
+		if !matched[k] {
+			result = append(result, obj)
+		}
+	}
+	sort.Sort(utils.AlphabeticalOrder(result))
+	return result
+}
+
+// Get implements LiveSource
+func (s *FileLiveSource) Get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	liveObj, ok := s.objects[s.key(obj)]
+	if !ok {
+		return nil, nil
+	}
+	return liveObj.DeepCopy(), nil
+}
@@ -15,6 +15,7 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -95,17 +96,53 @@ func isValidKindSchema(schema proto.Schema) bool {
 }
 
 func patch(existing, new *unstructured.Unstructured, schema proto.Schema) (*unstructured.Unstructured, error) {
+	pt, patch, err := createPatch(existing, new, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	existingData, err := existing.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var resData []byte
+	if pt == types.MergePatchType {
+		resData, err = jsonpatch.MergePatch(existingData, patch)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		patchMeta := strategicpatch.NewPatchMetaFromOpenAPI(schema)
+		resData, err = strategicpatch.StrategicMergePatchUsingLookupPatchMeta(existingData, patch, patchMeta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, _, err := unstructured.UnstructuredJSONScheme.Decode(resData, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*unstructured.Unstructured), nil
+}
+
+// createPatch returns the three-way patch from existing to new,
+// based on the AnnotationOrigObject annotation of existing.  This is
+// a strategic merge patch, or a JSON merge patch if schema is nil.
+func createPatch(existing, new *unstructured.Unstructured, schema proto.Schema) (types.PatchType, []byte, error) {
 	annos := existing.GetAnnotations()
 	var origData []byte
 	if data := annos[AnnotationOrigObject]; data != "" {
 		tmp := unstructured.Unstructured{}
 		err := utils.CompactDecodeObject(data, &tmp)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 		origData, err = tmp.MarshalJSON()
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 	}
 
@@ -115,7 +152,7 @@ func patch(existing, new *unstructured.Unstructured, schema proto.Schema) (*unst
 	utils.DeleteMetaDataAnnotation(new, AnnotationOrigObject)
 	data, err := utils.CompactEncodeObject(new)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	utils.SetMetaDataAnnotation(new, AnnotationOrigObject, data)
 
@@ -123,44 +160,23 @@ func patch(existing, new *unstructured.Unstructured, schema proto.Schema) (*unst
 
 	newData, err := new.MarshalJSON()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	existingData, err := existing.MarshalJSON()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	var resData []byte
 	if schema == nil {
 		// No schema information - fallback to JSON merge patch
 		patch, err := jsonmergepatch.CreateThreeWayJSONMergePatch(origData, newData, existingData)
-		if err != nil {
-			return nil, err
-		}
-		resData, err = jsonpatch.MergePatch(existingData, patch)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		patchMeta := strategicpatch.NewPatchMetaFromOpenAPI(schema)
-
-		patch, err := strategicpatch.CreateThreeWayMergePatch(origData, newData, existingData, patchMeta, true)
-		if err != nil {
-			return nil, err
-		}
-		resData, err = strategicpatch.StrategicMergePatchUsingLookupPatchMeta(existingData, patch, patchMeta)
-		if err != nil {
-			return nil, err
-		}
+		return types.MergePatchType, patch, err
 	}
 
-	result, _, err := unstructured.UnstructuredJSONScheme.Decode(resData, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return result.(*unstructured.Unstructured), nil
+	patchMeta := strategicpatch.NewPatchMetaFromOpenAPI(schema)
+	patch, err := strategicpatch.CreateThreeWayMergePatch(origData, newData, existingData, patchMeta, true)
+	return types.StrategicMergePatchType, patch, err
 }
 
 func createOrUpdate(rc dynamic.ResourceInterface, obj *unstructured.Unstructured, create bool, dryRun bool, schema proto.Schema, desc, dryRunText string) (*unstructured.Unstructured, error) {
@@ -17,6 +17,7 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -44,7 +45,7 @@ func Read(vm *jsonnet.VM, path string) ([]runtime.Object, error) {
 		}
 		defer f.Close()
 		return jsonReader(f)
-	} else if ext == ".yaml" {
+	} else if ext == ".yaml" || ext == ".yml" {
 		f, err := os.Open(path)
 		if err != nil {
 			return nil, err
@@ -70,22 +71,43 @@ func jsonReader(r io.Reader) ([]runtime.Object, error) {
 	return []runtime.Object{obj}, nil
 }
 
-func yamlReader(r io.ReadCloser) ([]runtime.Object, error) {
+// ParseObjects decodes a stream of YAML or JSON documents separated
+// by "---" lines, as found in a typical manifest file or on stdin.
+// Empty documents are skipped, and List objects are expanded into
+// their members.
+func ParseObjects(r io.Reader) ([]*unstructured.Unstructured, error) {
+	objs, err := yamlReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return FlattenToV1(objs), nil
+}
+
+func yamlReader(r io.Reader) ([]runtime.Object, error) {
 	decoder := yaml.NewYAMLReader(bufio.NewReader(r))
 	ret := []runtime.Object{}
 	for {
-		bytes, err := decoder.Read()
+		data, err := decoder.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return nil, err
 		}
-		if len(bytes) == 0 {
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
 			continue
 		}
-		jsondata, err := yaml.ToJSON(bytes)
-		if err != nil {
-			return nil, err
+		jsondata := data
+		if !json.Valid(data) {
+			// Not JSON, so convert from YAML
+			jsondata, err = yaml.ToJSON(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if bytes.Equal(jsondata, []byte("null")) {
+			// Document contained only comments
+			continue
 		}
 		obj, _, err := unstructured.UnstructuredJSONScheme.Decode(jsondata, nil, nil)
 		if err != nil {
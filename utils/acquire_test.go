@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -105,3 +106,42 @@ func TestJsonWalk(t *testing.T) {
 		}
 	}
 }
+
+func TestParseObjects(t *testing.T) {
+	input := `
+---
+# Just a comment
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+{
+	"apiVersion": "v1",
+	"kind": "List",
+	"items": [
+		{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "bar"}},
+		{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "baz"}}
+	]
+}
+---
+`
+	objs, err := ParseObjects(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseObjects returned error: %v", err)
+	}
+
+	names := []string{}
+	for _, o := range objs {
+		names = append(names, o.GetKind()+"/"+o.GetName())
+	}
+	expected := []string{"ConfigMap/foo", "Secret/bar", "Service/baz"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	if _, err := ParseObjects(strings.NewReader("kind: [")); err == nil {
+		t.Errorf("Expected error for invalid YAML")
+	}
+}